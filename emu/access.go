@@ -0,0 +1,29 @@
+package emu
+
+import (
+	"fmt"
+	"io"
+)
+
+// Access describes a single memory load or store
+type Access struct {
+	Addr  uint16 // Effective address (addr + offset)
+	Width uint8  // 1 or 2 bytes
+	Write bool
+	Data  uint16 // What was stored, or loaded if the load is done
+}
+
+func (a Access) String() string {
+	op := "R"
+	if a.Write {
+		op = "W"
+	}
+	return fmt.Sprintf("%s%d %04x %0*x", op, a.Width*8, a.Addr, a.Width*2, a.Data)
+}
+
+// LogAccesses returns a callback that writes each access to w, one per line
+func LogAccesses(w io.Writer) func(Access) {
+	return func(a Access) {
+		fmt.Fprintln(w, a)
+	}
+}
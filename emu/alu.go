@@ -0,0 +1,132 @@
+package emu
+
+import "math/bits"
+
+// Word is the size of a machine word. The Processor is built on uint16;
+// Core takes any of them, for trying out 8 and 32 bit variants of the
+// machine.
+type Word interface {
+	~uint8 | ~uint16 | ~uint32
+}
+
+// aluFlags are the flags the arithmetic and logic instructions replace
+const aluFlags = FlagZ | FlagC | FlagN | FlagV | FlagP
+
+// topBit is the sign bit of a W
+func topBit[W Word]() W {
+	return ^W(0) ^ ^W(0)>>1
+}
+
+// Arith performs the ALU opcode ADD, SUB, SHL, SHR, AND, OR, NOT or XOR on
+// a and b at W's width, returning the result and the flags it sets out of
+// aluFlags. NOT ignores b. Saturate clamps a carry or borrow as
+// Processor.Saturate does. ok is false for any other opcode.
+func Arith[W Word](opcode uint8, a, b W, saturate bool) (result W, flags uint16, ok bool) {
+	var carry, overflow bool
+	switch opcode {
+	case ADD:
+		result = a + b
+		carry, overflow = result < a, (a^result)&(b^result)&topBit[W]() != 0
+		if carry && saturate {
+			result = ^W(0)
+		}
+	case SUB:
+		result = a - b
+		carry, overflow = a < b, (a^b)&(a^result)&topBit[W]() != 0
+		if carry && saturate {
+			result = 0
+		}
+	case SHL:
+		result = a << b
+	case SHR:
+		result = a >> b
+	case AND:
+		result = a & b
+	case OR:
+		result = a | b
+	case NOT:
+		result = ^a
+	case XOR:
+		result = a ^ b
+	default:
+		return 0, 0, false
+	}
+	return result, flagsFor(result, carry, overflow), true
+}
+
+// flagsFor works out the aluFlags for an ALU result
+func flagsFor[W Word](result W, carry, overflow bool) (flags uint16) {
+	if result == 0 {
+		flags |= FlagZ
+	}
+	if bits.OnesCount64(uint64(result))%2 == 0 {
+		flags |= FlagP
+	}
+	if carry {
+		flags |= FlagC
+	}
+	if result&topBit[W]() != 0 {
+		flags |= FlagN
+	}
+	if overflow {
+		flags |= FlagV
+	}
+	return
+}
+
+// Reg is a register W wide. The Processor's Register is the 16 bit one,
+// kept as two bytes for the instructions that work on the low byte.
+type Reg[W Word] struct {
+	Value W
+}
+
+// Put saves d to the register
+func (r *Reg[W]) Put(d W) {
+	r.Value = d
+}
+
+// Get returns the register's value
+func (r *Reg[W]) Get() W {
+	return r.Value
+}
+
+// Core is the register file and ALU of the machine at any word size. It
+// runs the register only instructions, the ALU ops and the jumps, with the
+// same encoding as the Processor, so a program's arithmetic can be tried
+// at 8 or 32 bits. Memory, busses and interrupts stay with the 16 bit
+// Processor.
+type Core[W Word] struct {
+	Register [16]Reg[W]
+	Flags    uint16
+	Saturate bool // As Processor.Saturate
+}
+
+// Exec runs one instruction word, moving the IP past it unless it jumps
+func (c *Core[W]) Exec(inst uint16) error {
+	opcode, arg1, arg2, arg3 := uint8(inst>>12), uint8(inst>>8)&0xF, uint8(inst>>4)&0xF, uint8(inst)&0xF
+	r := &c.Register
+	switch opcode {
+	case LJUMP:
+		if r[arg1].Get() < r[arg2].Get() {
+			r[IP] = r[arg3]
+			return nil
+		}
+	case EJUMP:
+		if r[arg1].Get() == r[arg2].Get() {
+			r[IP] = r[arg3]
+			return nil
+		}
+	default:
+		if opcode == NOT && arg3 != 0 {
+			return ProcError{"Extended instructions need a Processor", FaultInstruction, uint16(r[IP].Get()), 0, []uint8{arg3}, nil}
+		}
+		data, flags, ok := Arith(opcode, r[arg2].Get(), r[arg3].Get(), c.Saturate)
+		if !ok {
+			return ProcError{"Instruction needs a Processor", FaultInstruction, uint16(r[IP].Get()), 0, []uint8{opcode}, nil}
+		}
+		r[arg1].Put(data)
+		c.Flags = c.Flags&^aluFlags | flags
+	}
+	r[IP].Put(r[IP].Get() + 2)
+	return nil
+}
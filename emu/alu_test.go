@@ -0,0 +1,81 @@
+package emu
+
+import "testing"
+
+// runCore runs the register only program code on c until the IP leaves it
+func runCore[W Word](t *testing.T, c *Core[W], code []uint8) {
+	t.Helper()
+	for n := 0; int(c.Register[IP].Get()) < len(code); n++ {
+		if n > 1000 {
+			t.Fatal("program never ended")
+		}
+		at := c.Register[IP].Get()
+		if err := c.Exec(uint16(code[at])<<8 | uint16(code[at+1])); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestCoreWidths(t *testing.T) {
+	// Sum 0 to 29 in r5: 435, which wraps at 8 bits
+	code, err := Assemble(`
+	loop:
+		add r5, r5, r1
+		add r1, r1, r3
+		ljump r1, r2, r4
+	`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var c8 Core[uint8]
+	c8.Register[2].Put(30)
+	c8.Register[3].Put(1)
+	runCore(t, &c8, code)
+	if got := c8.Register[5].Get(); got != 435%256 {
+		t.Errorf("8 bit sum is %d, want %d", got, 435%256)
+	}
+	var c16 Core[uint16]
+	c16.Register[2].Put(30)
+	c16.Register[3].Put(1)
+	runCore(t, &c16, code)
+	if got := c16.Register[5].Get(); got != 435 {
+		t.Errorf("16 bit sum is %d, want 435", got)
+	}
+}
+
+func TestCore8Flags(t *testing.T) {
+	for _, tc := range []struct {
+		name     string
+		inst     uint16 // Always r3 = r1 op r2
+		a, b     uint8
+		saturate bool
+		want     uint8
+		flags    uint16
+	}{
+		{"add carry", 0x8312, 200, 100, false, 44, FlagC},
+		{"add saturated", 0x8312, 200, 100, true, 0xff, FlagC | FlagN | FlagP},
+		{"add overflow", 0x8312, 0x7f, 1, false, 0x80, FlagN | FlagV},
+		{"sub borrow", 0x9312, 1, 0x7f, false, 0x82, FlagC | FlagN | FlagP},
+		{"sub saturated", 0x9312, 1, 0x7f, true, 0, FlagZ | FlagC | FlagP},
+		{"shl out the top", 0xa312, 0x81, 1, false, 0x02, 0},
+		{"not", 0xe310, 0x0f, 0, false, 0xf0, FlagN | FlagP},
+	} {
+		var c Core[uint8]
+		c.Saturate = tc.saturate
+		c.Register[1].Put(tc.a)
+		c.Register[2].Put(tc.b)
+		if err := c.Exec(tc.inst); err != nil {
+			t.Fatalf("%s: %v", tc.name, err)
+		}
+		if got := c.Register[3].Get(); got != tc.want || c.Flags != tc.flags {
+			t.Errorf("%s: got %#02x flags %x, want %#02x flags %x", tc.name, got, c.Flags, tc.want, tc.flags)
+		}
+	}
+
+	var c Core[uint8]
+	for _, inst := range []uint16{0x0312, 0x2300, 0xe121} { // load, set, iret
+		if err := c.Exec(inst); codeOf(err) != FaultInstruction {
+			t.Errorf("%04x on a Core gave %v, want an instruction fault", inst, err)
+		}
+	}
+}
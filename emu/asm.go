@@ -0,0 +1,579 @@
+package emu
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// Mnemonics for the primary opcodes
+var mnemonics = map[string]uint8{
+	"load":  LOAD,
+	"store": STORE,
+	"set":   SET,
+	"wbus":  WBUS,
+	"sbus":  SBUS,
+	"rbus":  RBUS,
+	"ljump": LJUMP,
+	"ejump": EJUMP,
+	"add":   ADD,
+	"sub":   SUB,
+	"shl":   SHL,
+	"shr":   SHR,
+	"and":   AND,
+	"or":    OR,
+	"not":   NOT,
+	"xor":   XOR,
+}
+
+// Mnemonics for the extended instructions, with how many register operands
+// each takes. The first two go in the instruction word, the rest in a
+// trailing byte.
+var extMnemonics = map[string]struct{ op, regs uint8 }{
+	"iret":   {IRET, 0},
+	"smul":   {SMUL, 4},
+	"setb":   {SETB, 1}, // Plus a constant, see encode
+	"memset": {MEMSET, 3},
+	"memcpy": {MEMCPY, 3},
+	"getf":   {GETF, 1},
+	"setf":   {SETF, 1},
+	"push":   {PUSH, 1},
+	"pop":    {POP, 1},
+	"call":   {CALL, 1},
+	"ret":    {RET, 0},
+	"peek":   {PEEK, 2},
+	"rload":  {RLOAD, 2},
+	"rstore": {RSTORE, 2},
+}
+
+// Mnemonics for the escaped instructions, with how many register operands
+// each takes. The first two go in the instruction word, the third beside
+// the instruction number and any fourth in the byte after that.
+var escMnemonics = map[string]struct{ op, regs uint8 }{
+	"nand":   {NAND, 3},
+	"nor":    {NOR, 3},
+	"mul":    {MUL, 4},
+	"pred":   {PRED, 0}, // Takes constants, see encodePred
+	"neg":    {NEG, 2},
+	"popcnt": {POPCNT, 2},
+	"sbusb":  {SBUSB, 1},
+	"rbusb":  {RBUSB, 1},
+	"halt":   {HALT, 0},
+}
+
+// Conditions pred accepts by name, as a flag mask and the value wanted
+var conditions = map[string][2]uint8{
+	"z":  {FlagZ, FlagZ},
+	"nz": {FlagZ, 0},
+	"c":  {FlagC, FlagC},
+	"nc": {FlagC, 0},
+	"n":  {FlagN, FlagN},
+	"nn": {FlagN, 0},
+	"v":  {FlagV, FlagV},
+	"nv": {FlagV, 0},
+}
+
+// Register aliases. Apart from ip and sp these are just conventions for
+// hand written code.
+var aliases = map[string]uint8{
+	"ip":   IP,
+	"sp":   SP,
+	"ret":  13, // Return value
+	"zero": 12, // Keep this at 0 for comparisons
+}
+
+// stmt is a single source line, after pseudo-instruction expansion
+type stmt struct {
+	line  int
+	label string
+	op    string
+	args  []string
+	addr  uint16 // Where it lands, filled in by the first pass
+	reloc bool   // A set from lea, whose value is an address to relocate
+}
+
+// Assemble turns assembly source into machine code, starting at address 0.
+//
+// Each line holds an optional "label:" and an optional instruction, with
+// operands separated by commas. Registers are r0 - r15 or one of the
+// aliases (ip, sp, ret, zero). Numbers may be decimal or 0x hex, and set
+// also accepts a label. Comments start with # or ;
+//
+// A few pseudo-instructions expand to real ones:
+//
+//	mov dst, src   ->  or dst, src, src
+//	jmp reg        ->  ejump reg, reg, reg
+//	clr reg        ->  xor reg, reg, reg
+//	nop            ->  ljump r0, r0, r0
+//	lea reg, label ->  set reg, label
+//
+// The set from lea is marked as a relocation in AssembleImage's output, so
+// the register gets the label's address wherever the program is loaded.
+// Plain set of a label gets the address as if loaded at 0.
+//
+// Directives control layout. A label on the same line as a directive gets
+// the address from before the directive takes effect.
+//
+//	.org addr   continue assembling at addr, which can't be behind us.
+//	            The gap is filled with zeros.
+//	.align n    pad with no-ops until the address is a multiple of n. Odd
+//	            gaps start with "set ip, <own address>", a 3 byte no-op;
+//	            a gap of exactly 1 byte can only be a zero.
+//	.byte v, ... emit each value as a byte. Values may be labels, but
+//	            have to fit.
+//	.word v, ... emit each value as a big endian word, labels included.
+//	.ascii "s"  emit the bytes of a Go style quoted string, escapes like
+//	            \n allowed, with no terminator. # and ; inside the quotes
+//	            don't start a comment.
+//
+// Data lands at the current address like instructions do, so a label in
+// front of it can be loaded with set.
+func Assemble(src string) ([]uint8, error) {
+	out, _, err := AssembleWithSymbols(src)
+	return out, err
+}
+
+// AssembleWithSymbols is Assemble, also returning the address of every label
+func AssembleWithSymbols(src string) ([]uint8, map[string]uint16, error) {
+	out, labels, _, err := assemble(src)
+	return out, labels, err
+}
+
+// AssembleImage assembles src into an Image to load at offset, starting at
+// the label "start" if there is one. The code is built for address 0 and
+// relocated by Boot, so every lea gets its label's real address.
+func AssembleImage(src string, offset uint16) (Image, error) {
+	out, labels, relocs, err := assemble(src)
+	if err != nil {
+		return Image{}, err
+	}
+	return Image{Data: out, Offset: offset, Start: offset + labels["start"], Relocations: relocs}, nil
+}
+
+// assemble is AssembleWithSymbols, also returning the positions of the
+// words lea left to relocate
+func assemble(src string) ([]uint8, map[string]uint16, []uint16, error) {
+	stmts, err := parseAsm(src)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+
+	// First pass: lay out addresses and find labels
+	labels := map[string]uint16{}
+	addr := uint32(0)
+	for i := range stmts {
+		s := &stmts[i]
+		s.addr = uint16(addr)
+		if s.label != "" {
+			if _, ok := labels[s.label]; ok {
+				return nil, nil, nil, fmt.Errorf("Line %d: duplicate label %q", s.line, s.label)
+			}
+			labels[s.label] = s.addr
+		}
+		size, err := s.size()
+		if err != nil {
+			return nil, nil, nil, fmt.Errorf("Line %d: %s", s.line, err)
+		}
+		if addr += uint32(size); addr > 0x10000 {
+			return nil, nil, nil, fmt.Errorf("Line %d: program runs past the end of memory", s.line)
+		}
+	}
+
+	// Second pass: encode
+	out := []uint8{}
+	var relocs []uint16
+	for _, s := range stmts {
+		b, err := s.encode(labels)
+		if err != nil {
+			return nil, nil, nil, fmt.Errorf("Line %d: %s", s.line, err)
+		}
+		// The set from lea, or the one padding an odd .align, both of
+		// which hold an address in the word after the first byte
+		if s.reloc || s.op == ".align" && len(b) >= 3 && len(b)%2 == 1 {
+			relocs = append(relocs, s.addr+1)
+		}
+		out = append(out, b...)
+	}
+	return out, labels, relocs, nil
+}
+
+// LoadAssembly assembles src and loads it into p at address 0 with
+// LoadProgram, ready to run. Execution starts at the label "start" if there
+// is one, otherwise at 0.
+func LoadAssembly(p *Processor, src string) error {
+	code, labels, err := AssembleWithSymbols(src)
+	if err != nil {
+		return err
+	}
+	return p.LoadProgram(NewBootmedia(code, 0, labels["start"]))
+}
+
+func parseAsm(src string) ([]stmt, error) {
+	var stmts []stmt
+	for n, line := range strings.Split(src, "\n") {
+		line = strings.TrimSpace(cutComment(line))
+		s := stmt{line: n + 1}
+		if i := strings.Index(line, ":"); i >= 0 && !strings.Contains(line[:i], `"`) {
+			s.label = strings.TrimSpace(line[:i])
+			if s.label == "" || strings.ContainsAny(s.label, " \t,") {
+				return nil, fmt.Errorf("Line %d: bad label %q", s.line, s.label)
+			}
+			line = strings.TrimSpace(line[i+1:])
+		}
+		if line != "" {
+			s.op, line = line, ""
+			if i := strings.IndexAny(s.op, " \t"); i >= 0 {
+				s.op, line = s.op[:i], s.op[i+1:]
+			}
+			s.op = strings.ToLower(s.op)
+			if line = strings.TrimSpace(line); s.op == ".ascii" {
+				s.args = []string{line} // Commas are part of the string
+			} else if line != "" {
+				for _, a := range strings.Split(line, ",") {
+					s.args = append(s.args, strings.TrimSpace(a))
+				}
+			}
+			if err := s.expand(); err != nil {
+				return nil, fmt.Errorf("Line %d: %s", s.line, err)
+			}
+		}
+		if s.label != "" || s.op != "" {
+			stmts = append(stmts, s)
+		}
+	}
+	return stmts, nil
+}
+
+// cutComment drops a # or ; comment from a line, unless it's inside a
+// quoted string
+func cutComment(line string) string {
+	quoted, escaped := false, false
+	for i, c := range line {
+		switch {
+		case escaped:
+			escaped = false
+		case quoted && c == '\\':
+			escaped = true
+		case c == '"':
+			quoted = !quoted
+		case !quoted && (c == '#' || c == ';'):
+			return line[:i]
+		}
+	}
+	return line
+}
+
+// expand rewrites pseudo-instructions into real ones
+func (s *stmt) expand() error {
+	switch s.op {
+	case "mov":
+		if len(s.args) != 2 {
+			return fmt.Errorf("mov takes 2 operands, got %d", len(s.args))
+		}
+		s.op, s.args = "or", []string{s.args[0], s.args[1], s.args[1]}
+	case "jmp":
+		if len(s.args) != 1 {
+			return fmt.Errorf("jmp takes 1 operand, got %d", len(s.args))
+		}
+		s.op, s.args = "ejump", []string{s.args[0], s.args[0], s.args[0]}
+	case "clr":
+		if len(s.args) != 1 {
+			return fmt.Errorf("clr takes 1 operand, got %d", len(s.args))
+		}
+		s.op, s.args = "xor", []string{s.args[0], s.args[0], s.args[0]}
+	case "nop":
+		if len(s.args) != 0 {
+			return fmt.Errorf("nop takes no operands")
+		}
+		s.op, s.args = "ljump", []string{"r0", "r0", "r0"} // r0 < r0 never jumps
+	case "lea":
+		if len(s.args) != 2 {
+			return fmt.Errorf("lea takes 2 operands, got %d", len(s.args))
+		}
+		s.op, s.reloc = "set", true
+	}
+	return nil
+}
+
+// directiveArg reads the single numeric argument of a directive
+func (s stmt) directiveArg() (uint16, error) {
+	if len(s.args) != 1 {
+		return 0, fmt.Errorf("%s takes 1 operand, got %d", s.op, len(s.args))
+	}
+	return parseValue(s.args[0], nil)
+}
+
+// ascii reads the string argument of .ascii
+func (s stmt) ascii() (string, error) {
+	if len(s.args) != 1 || s.args[0] == "" {
+		return "", fmt.Errorf(".ascii takes 1 quoted string")
+	}
+	str, err := strconv.Unquote(s.args[0])
+	if err != nil || !strings.HasPrefix(s.args[0], `"`) {
+		return "", fmt.Errorf("bad string %s", s.args[0])
+	}
+	return str, nil
+}
+
+// size is how many bytes the statement assembles to
+func (s stmt) size() (uint16, error) {
+	switch s.op {
+	case "":
+		return 0, nil
+	case ".org":
+		org, err := s.directiveArg()
+		if err != nil {
+			return 0, err
+		}
+		if org < s.addr {
+			return 0, fmt.Errorf(".org %x is behind the current address %x", org, s.addr)
+		}
+		return org - s.addr, nil
+	case ".align":
+		n, err := s.directiveArg()
+		if err != nil {
+			return 0, err
+		}
+		if n == 0 {
+			return 0, fmt.Errorf(".align needs a non-zero boundary")
+		}
+		return (n - s.addr%n) % n, nil
+	case ".byte", ".word":
+		if len(s.args) == 0 {
+			return 0, fmt.Errorf("%s needs at least 1 value", s.op)
+		}
+		if s.op == ".word" {
+			return uint16(2 * len(s.args)), nil
+		}
+		return uint16(len(s.args)), nil
+	case ".ascii":
+		str, err := s.ascii()
+		if len(str) > 0xFFFF {
+			return 0, fmt.Errorf("string too long")
+		}
+		return uint16(len(str)), err
+	}
+	if x, ok := extMnemonics[s.op]; ok {
+		return instrWidth(NOT, x.op), nil
+	}
+	if x, ok := escMnemonics[s.op]; ok {
+		return escWidth(x.op), nil
+	}
+	if op, ok := mnemonics[s.op]; ok {
+		return opWidths[op], nil
+	}
+	if strings.HasPrefix(s.op, ".") {
+		return 0, fmt.Errorf("unknown directive %q", s.op)
+	}
+	return 2, nil // Unknown, encode will complain
+}
+
+func (s stmt) encode(labels map[string]uint16) ([]uint8, error) {
+	switch s.op {
+	case "":
+		return nil, nil
+	case ".org":
+		size, _ := s.size()
+		return make([]uint8, size), nil
+	case ".align":
+		size, _ := s.size()
+		pad := make([]uint8, 0, size)
+		if size%2 == 1 && size >= 3 {
+			// set ip to our own address, which then steps past us
+			pad = append(pad, SET<<4|IP, uint8(s.addr>>8), uint8(s.addr))
+		}
+		for len(pad)+2 <= int(size) {
+			pad = append(pad, LJUMP<<4, 0x00)
+		}
+		return append(pad, make([]uint8, int(size)-len(pad))...), nil
+	case ".byte", ".word":
+		var out []uint8
+		for _, a := range s.args {
+			v, err := parseValue(a, labels)
+			if err != nil {
+				return nil, err
+			}
+			if s.op == ".word" {
+				out = append(out, uint8(v>>8), uint8(v))
+				continue
+			}
+			if v > 0xFF {
+				return nil, fmt.Errorf(".byte value %s doesn't fit in a byte", a)
+			}
+			out = append(out, uint8(v))
+		}
+		return out, nil
+	case ".ascii":
+		str, err := s.ascii()
+		return []uint8(str), err
+	}
+	if s.op == "setb" {
+		if len(s.args) != 2 {
+			return nil, fmt.Errorf("setb takes 2 operands, got %d", len(s.args))
+		}
+		r, err := parseReg(s.args[0])
+		if err != nil {
+			return nil, err
+		}
+		v, err := parseValue(s.args[1], labels)
+		if err != nil {
+			return nil, err
+		}
+		if v > 0xFF {
+			return nil, fmt.Errorf("setb constant %d doesn't fit in a byte", v)
+		}
+		return []uint8{NOT<<4 | r, SETB, uint8(v)}, nil
+	}
+	if x, ok := extMnemonics[s.op]; ok {
+		regs, err := parseRegs(s.args, int(x.regs))
+		if err != nil {
+			return nil, err
+		}
+		regs = append(regs, 0, 0, 0, 0)
+		out := []uint8{NOT<<4 | regs[0], regs[1]<<4 | x.op}
+		if x.regs > 2 {
+			out = append(out, regs[2]<<4|regs[3])
+		}
+		return out, nil
+	}
+	if s.op == "pred" {
+		return s.encodePred()
+	}
+	if x, ok := escMnemonics[s.op]; ok {
+		regs, err := parseRegs(s.args, int(x.regs))
+		if err != nil {
+			return nil, err
+		}
+		regs = append(regs, 0, 0, 0)
+		out := []uint8{NOT<<4 | regs[0], regs[1]<<4 | ESC, regs[2]<<4 | x.op}
+		if x.regs > 3 {
+			out = append(out, regs[3]<<4)
+		}
+		return out, nil
+	}
+	op, ok := mnemonics[s.op]
+	if !ok {
+		return nil, fmt.Errorf("unknown instruction %q", s.op)
+	}
+	switch op {
+	case SET:
+		if len(s.args) != 2 {
+			return nil, fmt.Errorf("set takes 2 operands, got %d", len(s.args))
+		}
+		r, err := parseReg(s.args[0])
+		if err != nil {
+			return nil, err
+		}
+		if _, ok := labels[s.args[1]]; s.reloc && !ok {
+			return nil, fmt.Errorf("lea needs a label, got %q", s.args[1])
+		}
+		v, err := parseValue(s.args[1], labels)
+		if err != nil {
+			return nil, err
+		}
+		return []uint8{op<<4 | r, uint8(v >> 8), uint8(v)}, nil
+	case WBUS, SBUS, RBUS:
+		regs, err := parseRegs(s.args, 1)
+		if err != nil {
+			return nil, err
+		}
+		return []uint8{op<<4 | regs[0]}, nil
+	case LOAD, STORE:
+		if len(s.args) != 2 && len(s.args) != 3 {
+			return nil, fmt.Errorf("%s takes 2 or 3 operands, got %d", s.op, len(s.args))
+		}
+		regs, err := parseRegs(s.args[:2], 2)
+		if err != nil {
+			return nil, err
+		}
+		size := uint8(0)
+		if len(s.args) == 3 {
+			switch s.args[2] {
+			case "8":
+				size = 1
+			case "16":
+			default:
+				return nil, fmt.Errorf("size must be 8 or 16, got %q", s.args[2])
+			}
+		}
+		return []uint8{op<<4 | regs[0], regs[1]<<4 | size}, nil
+	case NOT:
+		regs, err := parseRegs(s.args, 2)
+		if err != nil {
+			return nil, err
+		}
+		return []uint8{op<<4 | regs[0], regs[1] << 4}, nil
+	}
+	regs, err := parseRegs(s.args, 3)
+	if err != nil {
+		return nil, err
+	}
+	return []uint8{op<<4 | regs[0], regs[1]<<4 | regs[2]}, nil
+}
+
+// encodePred takes either a condition name or a flag mask and the value
+// wanted for those flags, each 0 - 15
+func (s stmt) encodePred() ([]uint8, error) {
+	var cond [2]uint8
+	switch len(s.args) {
+	case 1:
+		c, ok := conditions[strings.ToLower(s.args[0])]
+		if !ok {
+			return nil, fmt.Errorf("unknown condition %q", s.args[0])
+		}
+		cond = c
+	case 2:
+		for i, a := range s.args {
+			v, err := parseValue(a, nil)
+			if err != nil {
+				return nil, err
+			}
+			if v > 0xF {
+				return nil, fmt.Errorf("pred flags %d don't fit in 4 bits", v)
+			}
+			cond[i] = uint8(v)
+		}
+	default:
+		return nil, fmt.Errorf("pred takes a condition or a mask and value, got %d operands", len(s.args))
+	}
+	return []uint8{NOT<<4 | cond[0], cond[1]<<4 | ESC, PRED}, nil
+}
+
+func parseRegs(args []string, want int) ([]uint8, error) {
+	if len(args) != want {
+		return nil, fmt.Errorf("expected %d register operands, got %d", want, len(args))
+	}
+	regs := make([]uint8, want)
+	for i, a := range args {
+		r, err := parseReg(a)
+		if err != nil {
+			return nil, err
+		}
+		regs[i] = r
+	}
+	return regs, nil
+}
+
+func parseReg(a string) (uint8, error) {
+	a = strings.ToLower(a)
+	if r, ok := aliases[a]; ok {
+		return r, nil
+	}
+	if strings.HasPrefix(a, "r") {
+		if n, err := strconv.ParseUint(a[1:], 10, 8); err == nil && n < 16 {
+			return uint8(n), nil
+		}
+	}
+	return 0, fmt.Errorf("unknown register %q", a)
+}
+
+func parseValue(a string, labels map[string]uint16) (uint16, error) {
+	if v, ok := labels[a]; ok {
+		return v, nil
+	}
+	v, err := strconv.ParseUint(a, 0, 16)
+	if err != nil {
+		return 0, fmt.Errorf("bad value %q", a)
+	}
+	return uint16(v), nil
+}
@@ -0,0 +1,221 @@
+package emu
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestAssembleAliases(t *testing.T) {
+	for _, tc := range []struct {
+		src  string
+		want []uint8
+	}{
+		{"mov r1, r2", []uint8{0xd1, 0x22}},
+		{"jmp r3", []uint8{0x73, 0x33}},
+		{"clr r4", []uint8{0xf4, 0x44}},
+		{"nop", []uint8{0x60, 0x00}},
+		{"lea r5, here\nhere:", []uint8{0x25, 0x00, 0x03}},
+		{"add sp, ip, ret", []uint8{0x8e, 0xfd}},
+		{"mov r1, zero", []uint8{0xd1, 0xcc}},
+		{"MOV R1, R2", []uint8{0xd1, 0x22}},
+	} {
+		got, err := Assemble(tc.src)
+		if err != nil {
+			t.Errorf("%q: %v", tc.src, err)
+		} else if !bytes.Equal(got, tc.want) {
+			t.Errorf("%q assembled to % x, want % x", tc.src, got, tc.want)
+		}
+	}
+}
+
+func TestAlignOrg(t *testing.T) {
+	for _, tc := range []struct {
+		src  string
+		want []uint8
+		x    uint16
+	}{
+		{"nop\n.align 8\nx: nop", []uint8{0x60, 0, 0x60, 0, 0x60, 0, 0x60, 0, 0x60, 0}, 8},
+		{"sbus r1\n.align 4\nx:", []uint8{0x41, 0x2f, 0x00, 0x01}, 4}, // set ip, 1 is a 3 byte no-op
+		{"sbus r1\n.align 2\nx:", []uint8{0x41, 0}, 2},
+		{"x: .align 4\nnop", []uint8{0x60, 0}, 0},
+		{"sbus r1\n.org 6\nx: sbus r1", []uint8{0x41, 0, 0, 0, 0, 0, 0x41}, 6},
+		{"sbus r1\nx: .org 3", []uint8{0x41, 0, 0}, 1}, // The label is before the gap
+	} {
+		code, syms, err := AssembleWithSymbols(tc.src)
+		if err != nil {
+			t.Errorf("%q: %v", tc.src, err)
+			continue
+		}
+		if !bytes.Equal(code, tc.want) {
+			t.Errorf("%q assembled to % x, want % x", tc.src, code, tc.want)
+		}
+		if syms["x"] != tc.x {
+			t.Errorf("%q put x at %d, want %d", tc.src, syms["x"], tc.x)
+		}
+	}
+	if _, err := Assemble("nop\nnop\n.org 2\n.org 1"); err == nil {
+		t.Error(".org backwards assembled")
+	}
+}
+
+func TestAlignPaddingRuns(t *testing.T) {
+	p := newTestProcessor(t, "setb r1, 1\n.align 8\nadd r2, r1, r1")
+	steps(t, p, 4) // setb, a 3 byte set and a nop of padding, add
+	if r2, ip := p.Register[2].Get16(), p.Register[IP].Get16(); r2 != 2 || ip != 10 {
+		t.Errorf("r2 %d IP %d, want 2 and 10", r2, ip)
+	}
+}
+
+func TestSymbolMap(t *testing.T) {
+	code, syms, err := AssembleWithSymbols(`
+	start:
+		set r1, data    ; 3 bytes
+		sbus r1         ; 1
+	loop:
+		smul r1, r2, r3, r4 ; 3
+		jmp r1          ; 2
+	data:
+		.word 0xbeef
+	end:
+	`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]uint16{"start": 0, "loop": 4, "data": 9, "end": 11}
+	if len(syms) != len(want) {
+		t.Errorf("got symbols %v, want %v", syms, want)
+	}
+	for name, addr := range want {
+		if syms[name] != addr {
+			t.Errorf("%s at %d, want %d", name, syms[name], addr)
+		}
+	}
+	if len(code) != int(syms["end"]) {
+		t.Errorf("%d bytes of code, but end is at %d", len(code), syms["end"])
+	}
+	if code[syms["loop"]]>>4 != NOT || code[syms["data"]] != 0xbe {
+		t.Errorf("labels don't point at what follows them: % x", code)
+	}
+	if code[1] != 0 || code[2] != uint8(syms["data"]) {
+		t.Errorf("set loaded %02x%02x, want data's address", code[1], code[2])
+	}
+}
+
+func TestLoadAssembly(t *testing.T) {
+	p := NewProcessor(NewRAM(0x100), nil, &testBus{}, nil)
+	err := LoadAssembly(&p, `
+	total:
+		.word 0
+	start:
+		clr r3
+		setb r1, 1
+		setb r2, 11
+		set r4, loop
+		set r5, total
+		setb r6, 1
+	loop:
+		add r3, r3, r1
+		add r1, r1, r6
+		ljump r1, r2, r4
+		store r3, r5
+		halt
+	`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ip := p.Register[IP].Get16(); ip != 2 {
+		t.Fatalf("loaded with the IP at %d, want start at 2", ip)
+	}
+	for n := 0; !p.Halted(); n++ {
+		if n > 100 {
+			t.Fatal("no halt")
+		}
+		if _, err := p.Step(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if got, _ := p.Memory.Load16(0, 0); got != 55 {
+		t.Errorf("total is %d, want 55", got)
+	}
+}
+
+func TestStringTable(t *testing.T) {
+	p := newTestProcessor(t, `
+		set r1, table
+		setb r5, 2
+		add r1, r1, r5 ; Second entry
+		load r2, r1
+		set r6, 0x0103 ; Bus 1, r3
+		setb r7, 1
+		set r8, next
+		set r9, end
+	next:
+		load r3, r2, 8
+		ejump r3, r0, r9
+		sbus r6
+		add r2, r2, r7
+		jmp r8
+	end:
+		halt
+	table:
+		.word hello, bye
+	hello:
+		.ascii "hi, # there\n"
+		.byte 0
+	bye:
+		.ascii "bye; \"now\""
+		.byte 0
+	`)
+	for n := 0; !p.Halted(); n++ {
+		if n > 200 {
+			t.Fatal("no halt")
+		}
+		steps(t, p, 1)
+	}
+	var got []byte
+	for _, w := range p.Bus.(*testBus).sent {
+		got = append(got, uint8(w))
+	}
+	if string(got) != `bye; "now"` {
+		t.Errorf("printed %q, want the second string", got)
+	}
+}
+
+func TestLeaRelocated(t *testing.T) {
+	src := `
+	start:
+		lea r1, value
+		load r2, r1
+		lea r3, buffer
+		store r2, r3
+		halt
+	value:
+		.word 0x1234
+	buffer:
+		.word 0
+	`
+	_, syms, err := AssembleWithSymbols(src)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, offset := range []uint16{0, 0x40, 0x81} {
+		img, err := AssembleImage(src, offset)
+		if err != nil {
+			t.Fatal(err)
+		}
+		p := NewProcessor(NewRAM(0x100), img.Bootmedia(), &testBus{}, nil)
+		if err := p.Boot(); err != nil {
+			t.Fatal(err)
+		}
+		steps(t, &p, 4)
+		if r1 := p.Register[1].Get16(); r1 != offset+syms["value"] {
+			t.Errorf("at %#x: lea gave %#x, want %#x", offset, r1, offset+syms["value"])
+		}
+		if r2 := p.Register[2].Get16(); r2 != 0x1234 {
+			t.Errorf("at %#x: read %#x through it, want 0x1234", offset, r2)
+		}
+		if w, _ := p.Memory.Load16(offset, syms["buffer"]); w != 0x1234 {
+			t.Errorf("at %#x: buffer holds %#x, want 0x1234", offset, w)
+		}
+	}
+}
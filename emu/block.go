@@ -0,0 +1,137 @@
+package emu
+
+// blockLimit caps how many instructions one miss decodes ahead
+const blockLimit = 64
+
+// decoded is an instruction held by the block cache
+type decoded struct {
+	inst    uint16 // The word, as fetch returns it
+	imm     uint16 // InstrInfo.Imm
+	base    uint16 // instrWidth of the word
+	width   uint8  // Bytes of memory it was decoded from
+	valid   bool
+	checked bool  // checkArgs passed with RegisterLimit at limit
+	limit   uint8 // limitKey of RegisterLimit
+}
+
+// limitKey squeezes a RegisterLimit into a byte. Limits of 16 and up all
+// allow every register, and negative ones none but the IP.
+func limitKey(n int) uint8 {
+	return uint8(min(max(n, -1), 16))
+}
+
+// blockPage holds the cache entries for 256 bytes of the address space.
+// Pages are only made where code runs, which keeps a processor's cache to
+// a few KB instead of an entry for every address.
+type blockPage [256]decoded
+
+// blockTable is the block cache, paged by the high byte of the address
+type blockTable [256]*blockPage
+
+// at returns the entry for addr, making its page if need be
+func (t *blockTable) at(addr uint16) *decoded {
+	pg := t[addr>>8]
+	if pg == nil {
+		pg = new(blockPage)
+		t[addr>>8] = pg
+	}
+	return &pg[addr&0xFF]
+}
+
+// find returns the entry for addr, or nil if its page was never made
+func (t *blockTable) find(addr uint16) *decoded {
+	if pg := t[addr>>8]; pg != nil {
+		return &pg[addr&0xFF]
+	}
+	return nil
+}
+
+// cachedFetch is fetch through the block cache. A miss decodes the
+// straight line run of instructions from addr up to the next one that can
+// move the IP, so a loop body is read from memory once and then served
+// from the cache. d is nil when the instruction couldn't be cached,
+// leaving it to be run from memory as usual.
+func (p *Processor) cachedFetch(addr uint16) (inst uint16, d *decoded, err error) {
+	if p.blocks == nil {
+		p.blocks = new(blockTable)
+	}
+	if d = p.blocks.at(addr); !d.valid {
+		p.decodeBlock(addr)
+	}
+	if d.valid {
+		return d.inst, d, nil
+	}
+	inst, err = p.fetch(addr)
+	return inst, nil, err
+}
+
+// decodeBlock caches instructions from addr until one ends the block, one
+// is already cached, or memory can't be read. Reads go through the same
+// Memory calls execute and exec would make, so they see the same bytes.
+func (p *Processor) decodeBlock(addr uint16) {
+	for n := 0; n < blockLimit; n++ {
+		d := p.blocks.at(addr)
+		if d.valid {
+			return
+		}
+		inst, err := p.fetch(addr)
+		if err != nil {
+			return
+		}
+		in, err := Decode(p.mem(), addr)
+		if err != nil {
+			return
+		}
+		*d = decoded{inst: inst, imm: in.Imm, base: instrWidth(in.Opcode, in.Args[2]), width: uint8(in.Width), valid: true}
+		if endsBlock(in) || addr+in.Width < addr {
+			return
+		}
+		addr += in.Width
+	}
+}
+
+// endsBlock reports whether an instruction can send the IP anywhere but
+// the next instruction
+func endsBlock(in InstrInfo) bool {
+	switch {
+	case in.Opcode == LJUMP || in.Opcode == EJUMP:
+		return true
+	case in.Ext == IRET || in.Ext == CALL || in.Ext == RET:
+		return true
+	case in.Ext == ESC && in.Esc == PRED:
+		return true
+	}
+	regs, all := regWrites(in)
+	if all {
+		return true
+	}
+	for _, r := range regs {
+		if r == IP {
+			return true
+		}
+	}
+	return false
+}
+
+// invalidate drops cached instructions decoded from any of the n bytes
+// written at addr
+func (p *Processor) invalidate(addr, n uint16) {
+	if p.blocks == nil || n == 0 {
+		return
+	}
+	// Instructions are at most 4 bytes, so look from 3 bytes back
+	for i := uint32(0); i < uint32(n)+3; i++ {
+		d := p.blocks.find(addr - 3 + uint16(i))
+		if d != nil && d.valid && i+uint32(d.width) > 3 {
+			d.valid = false
+		}
+	}
+}
+
+// FlushBlocks empties the block cache. Boot and the other loaders do this
+// themselves, and the processor's own stores invalidate what they
+// overwrite; call it after changing memory any other way while BlockCache
+// is set. From a hook is fine, it takes no lock.
+func (p *Processor) FlushBlocks() {
+	p.blocks = nil
+}
@@ -0,0 +1,86 @@
+package emu
+
+import "testing"
+
+// A loop that rewrites an immediate it runs, so the cache has to notice
+const patching = `
+	set r2, 20
+	setb r3, 1
+	set r4, loop
+	set r6, imm
+loop:
+	.byte 0x25 # set r5, the word at imm
+imm:
+	.word 0
+	add r7, r7, r5
+	add r1, r1, r3
+	store r1, r6
+	ljump r1, r2, r4
+	halt
+`
+
+func TestBlockCacheSameResults(t *testing.T) {
+	naive, cached := newTestProcessor(t, patching), newTestProcessor(t, patching)
+	cached.BlockCache = true
+	for _, p := range []*Processor{naive, cached} {
+		for !p.Halted() {
+			steps(t, p, 1)
+		}
+	}
+	if got := cached.Register[7].Get16(); got != 190 {
+		t.Errorf("sum of the patched immediates %d, want 190", got)
+	}
+	if naive.Registers() != cached.Registers() || naive.Flags != cached.Flags {
+		t.Errorf("cached run ended with %v flags %x, uncached %v flags %x",
+			cached.Registers(), cached.Flags, naive.Registers(), naive.Flags)
+	}
+	for addr := uint16(0); addr < 0x40; addr++ {
+		a, _ := naive.Memory.Load8(addr, 0)
+		b, _ := cached.Memory.Load8(addr, 0)
+		if a != b {
+			t.Errorf("memory at %x is %x cached, %x uncached", addr, b, a)
+		}
+	}
+}
+
+func TestBlockCacheSetbIP(t *testing.T) {
+	p := newTestProcessor(t, `
+		setb ip, 3 ; Lands at 6 once the IP moves past it
+		setb r1, 1 ; Jumped over
+		setb r2, 2
+		halt
+	`)
+	p.BlockCache = true
+	for !p.Halted() {
+		steps(t, p, 1)
+	}
+	if r1, r2 := p.Register[1].Get16(), p.Register[2].Get16(); r1 != 0 || r2 != 2 {
+		t.Errorf("r1 %d r2 %d, want 0 and 2", r1, r2)
+	}
+	if d := p.blocks.find(3); d != nil && d.valid {
+		t.Error("the block went on past setb ip")
+	}
+}
+
+func BenchmarkBlockCache(b *testing.B) {
+	for _, cache := range []bool{false, true} {
+		name := "off"
+		if cache {
+			name = "on"
+		}
+		b.Run(name, func(b *testing.B) {
+			p := newTestProcessor(b, `
+				setb r3, 1
+				set r4, loop
+			loop:
+				add r1, r1, r3
+				xor r2, r1, r3
+				smul r5, r6, r1, r2
+				jmp r4
+			`)
+			p.BlockCache = cache
+			b.ResetTimer()
+			steps(b, p, b.N)
+		})
+	}
+}
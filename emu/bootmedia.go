@@ -0,0 +1,150 @@
+package emu
+
+import "errors"
+
+// sliceBootmedia serves a boot image held in memory
+type sliceBootmedia struct {
+	offset uint16
+	length uint16
+	start  uint16
+	data   []uint8
+}
+
+// NewBootmedia wraps a program image so it can be booted without a file.
+// The image is written to memory at offset and execution begins at start.
+func NewBootmedia(data []uint8, offset, start uint16) Bootmedia {
+	return &sliceBootmedia{
+		offset: offset,
+		length: uint16(len(data)),
+		start:  start,
+		data:   data,
+	}
+}
+
+// GetOffset tells us where to start writing mem
+func (b *sliceBootmedia) GetOffset() (uint16, error) {
+	return b.offset, nil
+}
+
+// GetLength states how much data is to be loaded from bootmedia
+func (b *sliceBootmedia) GetLength() (uint16, error) {
+	return b.length, nil
+}
+
+// GetIP returns the initial instruction pointer
+func (b *sliceBootmedia) GetIP() (uint16, error) {
+	return b.start, nil
+}
+
+// Load gets the boot data at a certain byte
+func (b *sliceBootmedia) Load(addr uint16) (uint8, error) {
+	if addr >= b.length {
+		return 0, errors.New("Load outside of bootmedia")
+	}
+	return b.data[addr], nil
+}
+
+// stackBootmedia adds an initial stack pointer to sliceBootmedia
+type stackBootmedia struct {
+	*sliceBootmedia
+	sp uint16
+}
+
+// NewStackBootmedia is NewBootmedia with the stack pointer starting at sp
+func NewStackBootmedia(data []uint8, offset, start, sp uint16) StackBootmedia {
+	return &stackBootmedia{NewBootmedia(data, offset, start).(*sliceBootmedia), sp}
+}
+
+// GetSP returns the initial stack pointer
+func (b *stackBootmedia) GetSP() (uint16, error) {
+	return b.sp, nil
+}
+
+// registerBootmedia adds seeded registers to sliceBootmedia
+type registerBootmedia struct {
+	*sliceBootmedia
+	regs map[uint8]uint16
+}
+
+// NewRegisterBootmedia is NewBootmedia with the registers in regs seeded
+// after boot, keyed by register number
+func NewRegisterBootmedia(data []uint8, offset, start uint16, regs map[uint8]uint16) RegisterBootmedia {
+	return &registerBootmedia{NewBootmedia(data, offset, start).(*sliceBootmedia), regs}
+}
+
+// GetRegisters returns the registers to seed
+func (b *registerBootmedia) GetRegisters() (map[uint8]uint16, error) {
+	return b.regs, nil
+}
+
+// relocBootmedia adds relocations to registerBootmedia, which may have no
+// seeds
+type relocBootmedia struct {
+	*registerBootmedia
+	relocs []uint16
+}
+
+// NewRelocatableBootmedia is NewBootmedia for a program built to load at 0,
+// with relocs listing where in data its addresses are. Boot adds offset to
+// each of them.
+func NewRelocatableBootmedia(data []uint8, offset, start uint16, relocs []uint16) RelocatableBootmedia {
+	return &relocBootmedia{&registerBootmedia{NewBootmedia(data, offset, start).(*sliceBootmedia), nil}, relocs}
+}
+
+// Relocations returns where the addresses to fix up are
+func (b *relocBootmedia) Relocations() ([]uint16, error) {
+	return b.relocs, nil
+}
+
+// segmentedBootmedia serves a boot image split across banks
+type segmentedBootmedia struct {
+	segments []Segment
+	bank     int
+	start    uint16
+}
+
+// NewSegmentedBootmedia makes bootmedia that loads each segment into its own
+// bank. Execution begins at start in the given bank. As plain Bootmedia it
+// presents just the first segment.
+func NewSegmentedBootmedia(segments []Segment, bank int, start uint16) SegmentedBootmedia {
+	return &segmentedBootmedia{segments, bank, start}
+}
+
+// Segments returns the pieces of the image
+func (b *segmentedBootmedia) Segments() ([]Segment, error) {
+	return b.segments, nil
+}
+
+// StartBank returns the bank to run from
+func (b *segmentedBootmedia) StartBank() (int, error) {
+	return b.bank, nil
+}
+
+// GetOffset tells us where the first segment goes
+func (b *segmentedBootmedia) GetOffset() (uint16, error) {
+	if len(b.segments) == 0 {
+		return 0, nil
+	}
+	return b.segments[0].Offset, nil
+}
+
+// GetLength states how long the first segment is
+func (b *segmentedBootmedia) GetLength() (uint16, error) {
+	if len(b.segments) == 0 {
+		return 0, nil
+	}
+	return uint16(len(b.segments[0].Data)), nil
+}
+
+// GetIP returns the initial instruction pointer
+func (b *segmentedBootmedia) GetIP() (uint16, error) {
+	return b.start, nil
+}
+
+// Load gets a byte of the first segment
+func (b *segmentedBootmedia) Load(addr uint16) (uint8, error) {
+	if len(b.segments) == 0 || int(addr) >= len(b.segments[0].Data) {
+		return 0, errors.New("Load outside of bootmedia")
+	}
+	return b.segments[0].Data[addr], nil
+}
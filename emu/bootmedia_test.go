@@ -0,0 +1,169 @@
+package emu
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"testing"
+)
+
+func TestBootFromBootmedia(t *testing.T) {
+	code := []uint8{0x21, 0x12, 0x34, 0x82, 0x11} // set r1, 0x1234; add r2, r1, r1
+	p := NewProcessor(NewRAM(0x1000), NewBootmedia(code, 0x100, 0x100), &testBus{}, nil)
+	if err := p.Boot(); err != nil {
+		t.Fatal(err)
+	}
+	for i, want := range code {
+		if got, _ := p.Memory.Load8(0x100+uint16(i), 0); got != want {
+			t.Errorf("byte %d booted as %02x, want %02x", i, got, want)
+		}
+	}
+	if ip := p.Register[IP].Get16(); ip != 0x100 {
+		t.Fatalf("IP %x after boot, want 100", ip)
+	}
+	steps(t, &p, 2)
+	if got := p.Register[2].Get16(); got != 0x2468 {
+		t.Errorf("r2 %x, want 2468", got)
+	}
+	if ip := p.Register[IP].Get16(); ip != 0x105 {
+		t.Errorf("IP %x after two instructions, want 105", ip)
+	}
+}
+
+func TestRangedBoot(t *testing.T) {
+	code := []uint8{1, 2, 3, 4, 5, 6, 7, 8}
+	p := NewProcessor(NewRAM(0x100), NewBootmedia(code, 0x10, 0x10), &testBus{}, nil)
+	var progress []string
+	err := p.Boot(BootOptions{
+		Start:    2,
+		End:      5,
+		Progress: func(loaded, total uint16) { progress = append(progress, fmt.Sprintf("%d/%d", loaded, total)) },
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for addr, want := range map[uint16]uint8{0x11: 0, 0x12: 3, 0x13: 4, 0x14: 5, 0x15: 0} {
+		if got, _ := p.Memory.Load8(addr, 0); got != want {
+			t.Errorf("byte at %x is %d, want %d", addr, got, want)
+		}
+	}
+	if got := fmt.Sprint(progress); got != "[1/3 2/3 3/3]" {
+		t.Errorf("progress went %s", got)
+	}
+	if err := p.Boot(BootOptions{Start: 9}); err == nil {
+		t.Error("booted a range past the end of the bootmedia")
+	}
+}
+
+func TestBootErrorLoaded(t *testing.T) {
+	// RAM ends 4 bytes into the image
+	p := NewProcessor(NewRAM(0x20), NewBootmedia(make([]uint8, 8), 0x1c, 0x1c), &testBus{}, nil)
+	err := p.Boot()
+	var be BootError
+	if !errors.As(err, &be) {
+		t.Fatalf("got %v, want a BootError", err)
+	}
+	if be.Loaded != 4 || be.Code() != FaultBoot {
+		t.Errorf("loaded %d code %d, want 4 and %d", be.Loaded, be.Code(), FaultBoot)
+	}
+
+	// Counted from the start of a ranged boot
+	err = p.Boot(BootOptions{Start: 1})
+	if !errors.As(err, &be) || be.Loaded != 3 {
+		t.Errorf("ranged boot gave %v, want 3 bytes loaded", err)
+	}
+}
+
+func TestSegmentedBoot(t *testing.T) {
+	m := newBankedRAM(2, 0x1000)
+	segments := []Segment{{0, 0x10, []uint8{1, 2}}, {1, 0x20, []uint8{3, 4, 5}}}
+	p := NewProcessor(m, NewSegmentedBootmedia(segments, 1, 0x20), &testBus{}, nil)
+	if err := p.Boot(); err != nil {
+		t.Fatal(err)
+	}
+	for _, seg := range segments {
+		for i, want := range seg.Data {
+			if got, _ := m.banks[seg.Bank].Load8(seg.Offset, uint16(i)); got != want {
+				t.Errorf("bank %d byte %x is %d, want %d", seg.Bank, seg.Offset+uint16(i), got, want)
+			}
+		}
+	}
+	if m.Bank() != 1 || p.Register[IP].Get16() != 0x20 {
+		t.Errorf("started in bank %d at %x, want bank 1 at 20", m.Bank(), p.Register[IP].Get16())
+	}
+
+	segments = []Segment{{0, 0xfff, []uint8{1, 2}}} // One byte over the end of the bank
+	p = NewProcessor(m, NewSegmentedBootmedia(segments, 0, 0), &testBus{}, nil)
+	if err := p.Boot(); err == nil {
+		t.Error("booted a segment that doesn't fit its bank")
+	}
+}
+
+func TestSeededRegisters(t *testing.T) {
+	img, err := ParseImage([]byte("0010 0010 r3=1f00 60 00 r14=0080 r0=ffff"), binary.BigEndian)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p := NewProcessor(NewRAM(0x100), img.Bootmedia(), &testBus{}, nil)
+	if err := p.Boot(); err != nil {
+		t.Fatal(err)
+	}
+	check := func(when string) {
+		t.Helper()
+		for r, want := range map[int]uint16{0: 0xffff, 3: 0x1f00, SP: 0x80, IP: 0x10, 1: 0} {
+			if got := p.Register[r].Get16(); got != want {
+				t.Errorf("%s r%d is %#x, want %#x", when, r, got, want)
+			}
+		}
+	}
+	check("after boot")
+	p.Register[3].Put16(0)
+	steps(t, &p, 1)
+	if err := p.WarmReset(); err != nil {
+		t.Fatal(err)
+	}
+	check("after a warm reset")
+
+	for _, bad := range []string{"0000 0000 r15=0001", "0000 0000 r3=1 r3=2", "0000 0000 rx=1", "0000 0000 r1=zz"} {
+		if _, err := ParseImage([]byte(bad), binary.BigEndian); err == nil {
+			t.Errorf("%q parsed", bad)
+		}
+	}
+	p = NewProcessor(NewRAM(0x100), NewRegisterBootmedia([]uint8{0x60, 0}, 0, 0, map[uint8]uint16{IP: 4}), &testBus{}, nil)
+	if err := p.Boot(); codeOf(err) != FaultBoot {
+		t.Errorf("seeding the IP gave %v, want a boot fault", err)
+	}
+}
+
+func TestRelocation(t *testing.T) {
+	// set r1, there; jmp r1; there: set r2, 7; then a word holding there.
+	// Built for 0, with both addresses of there marked.
+	const prog = "@0001 21 0005 71 11 22 0007 @0008 0005"
+	for _, base := range []uint16{0x10, 0x40} {
+		img, err := ParseImage([]byte(fmt.Sprintf("%04x %04x %s", base, base, prog)), binary.BigEndian)
+		if err != nil {
+			t.Fatal(err)
+		}
+		p := NewProcessor(NewRAM(0x100), img.Bootmedia(), &testBus{}, nil)
+		if err := p.Boot(); err != nil {
+			t.Fatal(err)
+		}
+		steps(t, &p, 3)
+		if r1, r2 := p.Register[1].Get16(), p.Register[2].Get16(); r1 != base+5 || r2 != 7 {
+			t.Errorf("at %#x: jumped to %#x and set r2 to %d, want %#x and 7", base, r1, r2, base+5)
+		}
+		if w, _ := p.Memory.Load16(base, 8); w != base+5 {
+			t.Errorf("at %#x: data word is %#x, want %#x", base, w, base+5)
+		}
+	}
+
+	for _, bad := range []string{"0000 0000 @0008 21 0005", "0000 0000 @0001 @1 21 0005", "0000 0000 @zz 21 0005"} {
+		if _, err := ParseImage([]byte(bad), binary.BigEndian); err == nil {
+			t.Errorf("%q parsed", bad)
+		}
+	}
+	p := NewProcessor(NewRAM(0x100), NewRelocatableBootmedia([]uint8{0x21, 0, 5}, 0x10, 0x10, []uint16{2}), &testBus{}, nil)
+	if err := p.Boot(); err == nil {
+		t.Error("booted with a relocation running past the end")
+	}
+}
@@ -0,0 +1,419 @@
+package emu
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"sync/atomic"
+)
+
+// ChanBus is a Bus made of channels, for hosts that want working busses
+// without writing their own. Each bus has an output side carrying what the
+// cpu sends and an input side carrying data for the cpu to receive; the
+// host reads and writes the other ends with Output and Input.
+type ChanBus struct {
+	buffer int
+	ch     []chanPair
+	names  map[string]uint8 // Busses added with AddNamed
+
+	mu       sync.RWMutex // Held for reading while raising, writing to close
+	c        chan<- Interrupt
+	closed   bool
+	quit     chan struct{} // Closed first, to unblock raisers before c closes
+	quitOnce sync.Once
+	gone     chan struct{} // Closed by DetachInterrupts, to unblock raisers before c is dropped
+	goneOnce *sync.Once    // One per attached c
+}
+
+type chanPair struct {
+	out     chan uint16 // cpu -> host
+	in      chan uint16 // host -> cpu
+	held    bool        // head was taken off in by Peek or Which
+	head    uint16
+	ready   bool   // Deliver raises an interrupt
+	handler uint16 // Handler for it
+	policy  QueuePolicy
+	dropped *atomic.Uint64 // Words discarded by policy, shared by copies
+	tags    *mailbox       // Replies waiting for RecvTagged
+}
+
+// mailbox sorts the cpu's tagged replies by tag so concurrent requesters
+// each get their own. One requester at a time reads the output chan,
+// filing whatever arrives; the rest wait for it to be filed.
+type mailbox struct {
+	mu      sync.Mutex
+	arrived *sync.Cond
+	reading bool
+	replies map[uint8][]uint8
+}
+
+// QueuePolicy says what a bus does with a word that arrives while its queue
+// is full
+type QueuePolicy int
+
+// Bus queue full policies
+const (
+	QueueBlock      QueuePolicy = iota // The sender waits for room
+	QueueDropOldest                    // The oldest queued word is discarded to make room
+	QueueDropNewest                    // The new word is discarded
+)
+
+// NewBus makes an empty ChanBus whose busses buffer this many words each
+// way. Add busses with Add before handing it to a processor.
+func NewBus(buffer int) *ChanBus {
+	return &ChanBus{buffer: buffer, quit: make(chan struct{})}
+}
+
+// Add makes a new bus and returns its address
+func (b *ChanBus) Add() uint8 {
+	return b.AddQueue(b.buffer, QueueBlock)
+}
+
+// AddNamed is Add, also registering the bus under name so host code and
+// tooling can find it with ByName. Names must be unique.
+func (b *ChanBus) AddNamed(name string) uint8 {
+	if _, ok := b.names[name]; ok {
+		panic(fmt.Sprintf("Bus name %q already in use", name))
+	}
+	addr := b.Add()
+	if b.names == nil {
+		b.names = map[string]uint8{}
+	}
+	b.names[name] = addr
+	return addr
+}
+
+// ByName looks up the address of a bus added with AddNamed
+func (b *ChanBus) ByName(name string) (uint8, bool) {
+	addr, ok := b.names[name]
+	return addr, ok
+}
+
+// AddQueue makes a new bus whose queues hold up to limit words each way,
+// applying policy when one is full, and returns its address. The drop
+// policies model a lossy hardware FIFO: nobody waits, and Dropped counts
+// what's lost. They need a limit of at least 1, and on the input side only
+// apply to words given with Deliver.
+func (b *ChanBus) AddQueue(limit int, policy QueuePolicy) uint8 {
+	if len(b.ch) >= INTSOURCE {
+		panic("No bus addresses left")
+	}
+	if policy != QueueBlock && limit < 1 {
+		panic("Dropping bus queues need a limit of at least 1")
+	}
+	b.ch = append(b.ch, chanPair{
+		out:     make(chan uint16, limit),
+		in:      make(chan uint16, limit),
+		policy:  policy,
+		dropped: new(atomic.Uint64),
+		tags:    newMailbox(),
+	})
+	return uint8(len(b.ch) - 1)
+}
+
+// Dropped is how many words a bus's drop policy has discarded, both ways
+func (b *ChanBus) Dropped(addr uint8) uint64 {
+	c, err := b.pair(addr)
+	if err != nil {
+		return 0
+	}
+	return c.dropped.Load()
+}
+
+// put queues data on ch, one of c's chans, as c's policy says
+func (c *chanPair) put(ch chan uint16, data uint16) {
+	if c.policy == QueueBlock {
+		ch <- data
+		return
+	}
+	for {
+		select {
+		case ch <- data:
+			return
+		default:
+		}
+		if c.policy == QueueDropNewest {
+			c.dropped.Add(1)
+			return
+		}
+		select {
+		case <-ch:
+			c.dropped.Add(1)
+		default: // The reader took one meanwhile, there's room now
+		}
+	}
+}
+
+func newMailbox() *mailbox {
+	m := &mailbox{replies: map[uint8][]uint8{}}
+	m.arrived = sync.NewCond(&m.mu)
+	return m
+}
+
+// Output is where the host reads what the cpu sends on a bus, nil if
+// there's no such bus
+func (b *ChanBus) Output(addr uint8) <-chan uint16 {
+	c, err := b.pair(addr)
+	if err != nil {
+		return nil
+	}
+	return c.out
+}
+
+// Input is where the host writes data for the cpu to receive on a bus, nil
+// if there's no such bus
+func (b *ChanBus) Input(addr uint8) chan<- uint16 {
+	c, err := b.pair(addr)
+	if err != nil {
+		return nil
+	}
+	return c.in
+}
+
+func (b *ChanBus) pair(addr uint8) (*chanPair, error) {
+	if int(addr) >= len(b.ch) {
+		return nil, fmt.Errorf("Invalid bus address %d", addr)
+	}
+	return &b.ch[addr], nil
+}
+
+// ReadyInterrupt makes Deliver on a bus raise an interrupt for handler, its
+// BusAddr the bus, so the guest can wait for data instead of polling with
+// WBUS. Set it up before the processor runs.
+func (b *ChanBus) ReadyInterrupt(addr uint8, handler uint16) error {
+	c, err := b.pair(addr)
+	if err != nil {
+		return err
+	}
+	c.ready, c.handler = true, handler
+	return nil
+}
+
+// Deliver gives data to the cpu on a bus, like writing to Input, raising
+// the bus's ready interrupt if it has one. The interrupt comes once the
+// data is buffered, or, when there's no room for it, before waiting for
+// room: the handler's RBUS is what makes it. Busses with a drop policy
+// never wait.
+func (b *ChanBus) Deliver(addr uint8, data uint16) error {
+	c, err := b.pair(addr)
+	if err != nil {
+		return err
+	}
+	if !c.ready {
+		c.put(c.in, data)
+		return nil
+	}
+	i := Interrupt{BusAddr: addr, Handler: c.handler}
+	select {
+	case c.in <- data:
+		return b.Raise(i)
+	default:
+	}
+	if c.policy != QueueBlock {
+		c.put(c.in, data)
+		return b.Raise(i)
+	}
+	if err := b.Raise(i); err != nil {
+		return err
+	}
+	c.in <- data
+	return nil
+}
+
+// Tagged transactions let several host goroutines use a device the guest
+// implements at once, each getting the reply to its own request. Every
+// word carries a tag in its high byte and a payload in its low byte. The
+// guest reads a request with RBUS and answers it with SBUS on the same bus,
+// keeping the high byte; it may answer in any order.
+
+// SendTagged gives payload to the cpu on a bus as a request with the given
+// tag, with Deliver. The tag should be one no other outstanding request on
+// the bus is using.
+func (b *ChanBus) SendTagged(addr, tag, payload uint8) error {
+	return b.Deliver(addr, uint16(tag)<<8|uint16(payload))
+}
+
+// RecvTagged waits for the cpu's reply to tag on a bus, leaving replies to
+// other tags for their own requesters. While anyone uses it, the bus's
+// Output must not be read any other way. It fails once the bus is closed.
+func (b *ChanBus) RecvTagged(addr, tag uint8) (uint8, error) {
+	c, err := b.pair(addr)
+	if err != nil {
+		return 0, err
+	}
+	m := c.tags
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for {
+		if q := m.replies[tag]; len(q) > 0 {
+			m.replies[tag] = q[1:]
+			return q[0], nil
+		}
+		if m.reading {
+			m.arrived.Wait()
+			continue
+		}
+		m.reading = true
+		m.mu.Unlock()
+		var data uint16
+		var ok bool
+		select {
+		case data, ok = <-c.out:
+		case <-b.quit:
+		}
+		m.mu.Lock()
+		m.reading = false
+		m.arrived.Broadcast() // Someone else reads next if this was ours
+		if !ok {
+			return 0, errors.New("Bus closed")
+		}
+		t := uint8(data >> 8)
+		m.replies[t] = append(m.replies[t], uint8(data))
+	}
+}
+
+// Send puts data on a bus, waiting for the host if the buffer is full
+// unless the bus drops instead
+func (b *ChanBus) Send(addr uint8, data uint16) error {
+	c, err := b.pair(addr)
+	if err != nil {
+		return err
+	}
+	c.put(c.out, data)
+	return nil
+}
+
+// Recv waits for data on a bus. It fails once the host closes the input.
+func (b *ChanBus) Recv(addr uint8) (uint16, error) {
+	c, err := b.pair(addr)
+	if err != nil {
+		return 0, err
+	}
+	if c.held {
+		c.held = false
+		return c.head, nil
+	}
+	data, ok := <-c.in
+	if !ok {
+		return 0, errors.New("Bus input closed")
+	}
+	return data, nil
+}
+
+// Peek returns the next value Recv would get from a bus without blocking
+// or consuming it. Like Recv it should only be called by the cpu.
+func (b *ChanBus) Peek(addr uint8) (uint16, bool) {
+	c, err := b.pair(addr)
+	if err != nil {
+		return 0, false
+	}
+	if !c.held {
+		select {
+		case data, ok := <-c.in:
+			if !ok {
+				return 0, false
+			}
+			c.head, c.held = data, true
+		default:
+			return 0, false
+		}
+	}
+	return c.head, true
+}
+
+// Which returns the address of the lowest bus with data waiting. A host
+// blocked writing to an unbuffered bus counts; the word it was writing is
+// held for the next Recv.
+func (b *ChanBus) Which() (uint8, error) {
+	for i := range b.ch {
+		if _, ok := b.Peek(uint8(i)); ok {
+			return uint8(i), nil
+		}
+	}
+	return 0, errors.New("No data")
+}
+
+// Broadcast puts data on every bus without blocking. Busses with a drop
+// policy apply it; others that aren't ready to take it are skipped and
+// reported.
+func (b *ChanBus) Broadcast(data uint16) error {
+	var missed []int
+	for i := range b.ch {
+		if c := &b.ch[i]; c.policy != QueueBlock {
+			c.put(c.out, data)
+			continue
+		}
+		select {
+		case b.ch[i].out <- data:
+		default:
+			missed = append(missed, i)
+		}
+	}
+	if len(missed) > 0 {
+		return fmt.Errorf("Broadcast not delivered to busses %v", missed)
+	}
+	return nil
+}
+
+// Interrupts receives an interrupt chan from cpu. Calling it again, after
+// DetachInterrupts or not, replaces the chan.
+func (b *ChanBus) Interrupts(c chan<- Interrupt) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.c = c
+	b.gone = make(chan struct{})
+	b.goneOnce = new(sync.Once)
+}
+
+// DetachInterrupts forgets the interrupt chan without closing it, for
+// handing the bus to another cpu or shutting its devices down while the
+// cpu lives on. Raisers blocked on the old chan give up, and later
+// interrupts are dropped with an error until Interrupts attaches a new one.
+// The old chan is left for its owner to close.
+func (b *ChanBus) DetachInterrupts() {
+	b.mu.RLock()
+	gone, once := b.gone, b.goneOnce
+	b.mu.RUnlock()
+	if once == nil {
+		return // Never attached
+	}
+	once.Do(func() { close(gone) })
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.gone == gone { // Not reattached in the meantime
+		b.c = nil
+	}
+}
+
+// Raise delivers an interrupt from a device to the cpu. It is safe to race
+// with Close and DetachInterrupts; once either has begun the interrupt is
+// dropped with an error.
+func (b *ChanBus) Raise(i Interrupt) error {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	if b.closed {
+		return errors.New("Interrupts are closed")
+	}
+	if b.c == nil {
+		return errors.New("Interrupts are detached")
+	}
+	select {
+	case b.c <- i:
+		return nil
+	case <-b.quit:
+		return errors.New("Interrupts are closed")
+	case <-b.gone:
+		return errors.New("Interrupts are detached")
+	}
+}
+
+// Close shuts the interrupt chan, which stops the cpu
+func (b *ChanBus) Close() {
+	b.quitOnce.Do(func() { close(b.quit) })
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.c != nil && !b.closed {
+		close(b.c)
+		b.closed = true
+	}
+}
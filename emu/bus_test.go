@@ -0,0 +1,354 @@
+package emu
+
+import (
+	"slices"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestTaggedPairing(t *testing.T) {
+	// The guest answers each request with its payload plus one, tag kept
+	code, err := Assemble(`
+		set r0, 0x0001 # bus 0, data in r1
+		setb r2, 1
+		set r3, loop
+	loop:
+		rbus r0
+		add r1, r1, r2
+		sbus r0
+		jmp r3
+	`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b := NewBus(0)
+	b.Add()
+	tick := make(chan time.Time)
+	close(tick) // Free running
+	p := NewProcessor(NewRAM(0x1000), NewBootmedia(code, 0, 0), b, tick)
+	if err := p.Boot(); err != nil {
+		t.Fatal(err)
+	}
+	errs := make(chan error, 1)
+	go p.Run(errs)
+	defer b.Close()
+
+	var wg sync.WaitGroup
+	for g := range 8 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for n := range 20 {
+				tag, payload := uint8(g*20+n), uint8(g*10+n)
+				if err := b.SendTagged(0, tag, payload); err != nil {
+					t.Error(err)
+					return
+				}
+				got, err := b.RecvTagged(0, tag)
+				if err != nil {
+					t.Error(err)
+					return
+				}
+				if got != payload+1 {
+					t.Errorf("tag %d: got %d, want %d", tag, got, payload+1)
+				}
+			}
+		}()
+	}
+	wg.Wait()
+}
+
+func TestTaggedClosed(t *testing.T) {
+	b := NewBus(0)
+	b.Add()
+	b.Close()
+	if _, err := b.RecvTagged(0, 1); err == nil {
+		t.Fatal("RecvTagged on a closed bus should fail")
+	}
+	if _, err := b.RecvTagged(1, 1); err == nil {
+		t.Fatal("RecvTagged on a missing bus should fail")
+	}
+}
+
+func TestByName(t *testing.T) {
+	b := NewBus(0)
+	b.Add()
+	tty := b.AddNamed("tty")
+	done := b.AddNamed("done")
+	if tty != 1 || done != 2 {
+		t.Fatalf("addresses %d %d", tty, done)
+	}
+	if addr, ok := b.ByName("done"); !ok || addr != done {
+		t.Fatalf("done resolved to %d %v", addr, ok)
+	}
+	if _, ok := b.ByName("raw"); ok {
+		t.Fatal("raw was never added")
+	}
+	defer func() {
+		if recover() == nil {
+			t.Fatal("reusing a name should panic")
+		}
+	}()
+	b.AddNamed("tty")
+}
+
+func TestDetachInterrupts(t *testing.T) {
+	b := NewBus(0)
+	b.DetachInterrupts() // Never attached, nothing to do
+	c := make(chan Interrupt)
+	b.Interrupts(c)
+
+	// A raiser blocked on the chan is let go
+	raised := make(chan error)
+	go func() { raised <- b.Raise(Interrupt{BusAddr: 1}) }()
+	time.Sleep(10 * time.Millisecond)
+	b.DetachInterrupts()
+	if err := <-raised; err == nil {
+		t.Fatal("blocked Raise should fail once detached")
+	}
+	if err := b.Raise(Interrupt{}); err == nil {
+		t.Fatal("Raise after detaching should fail")
+	}
+	close(c) // Still ours, and nothing sends on it any more
+
+	c2 := make(chan Interrupt, 1)
+	b.Interrupts(c2)
+	if err := b.Raise(Interrupt{BusAddr: 2}); err != nil {
+		t.Fatal(err)
+	}
+	if i := <-c2; i.BusAddr != 2 {
+		t.Fatalf("got %+v", i)
+	}
+	b.Close()
+	if err := b.Raise(Interrupt{}); err == nil {
+		t.Fatal("Raise after Close should fail")
+	}
+}
+
+func TestRunWithHandlersUnknownBus(t *testing.T) {
+	b := NewBus(0)
+	b.Add()
+	p := NewProcessor(NewRAM(0x100), NewBootmedia([]uint8{0, 0}, 0, 0), b, nil)
+	err := p.RunWithHandlers(map[uint8]func(uint16){0: func(uint16) {}, 3: func(uint16) {}}, make(chan error))
+	if err == nil {
+		t.Fatal("a handler for a missing bus should be an error")
+	}
+	if b.Output(3) != nil || b.Input(3) != nil {
+		t.Fatal("missing bus should have nil chans")
+	}
+}
+
+func TestPeekThenRecv(t *testing.T) {
+	code, err := Assemble(`
+		set r1, 0x0002 ; Bus 0 into r2
+		peek r1, r4
+		rbus r1
+		peek r1, r5
+	`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b := NewBus(1)
+	addr := b.Add()
+	p := NewProcessor(NewRAM(0x100), NewBootmedia(code, 0, 0), b, nil)
+	if err := p.Boot(); err != nil {
+		t.Fatal(err)
+	}
+	b.Input(addr) <- 42
+	steps(t, &p, 2)
+	if r2, r4 := p.Register[2].Get16(), p.Register[4].Get16(); r2 != 42 || r4 != 1 {
+		t.Fatalf("peek gave %d present %d, want 42 present 1", r2, r4)
+	}
+	p.Register[2].Put16(0)
+	steps(t, &p, 1)
+	if r2 := p.Register[2].Get16(); r2 != 42 {
+		t.Errorf("recv after peek got %d, want 42", r2)
+	}
+	steps(t, &p, 1)
+	if r5 := p.Register[5].Get16(); r5 != 0 {
+		t.Errorf("peek after recv says present %d, want 0", r5)
+	}
+}
+
+func TestChanBusSendRecv(t *testing.T) {
+	b := NewBus(2)
+	in, out := b.Add(), b.Add()
+	if _, err := b.Which(); err == nil {
+		t.Error("Which found data on empty busses")
+	}
+
+	// Buffered both ways, so none of this waits
+	if err := b.Send(out, 0x1234); err != nil {
+		t.Fatal(err)
+	}
+	if err := b.Send(out, 0x5678); err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []uint16{0x1234, 0x5678} {
+		if got := <-b.Output(out); got != want {
+			t.Errorf("host read %#x, want %#x", got, want)
+		}
+	}
+	b.Input(in) <- 0xbeef
+	if addr, err := b.Which(); err != nil || addr != in {
+		t.Errorf("Which gave %d, %v, want bus %d", addr, err, in)
+	}
+	if got, err := b.Recv(in); err != nil || got != 0xbeef {
+		t.Errorf("Recv gave %#x, %v, want 0xbeef", got, err)
+	}
+	if _, err := b.Which(); err == nil {
+		t.Error("Which found data after it was read")
+	}
+
+	if b.Input(2) != nil || b.Output(2) != nil {
+		t.Error("chans for a bus that doesn't exist")
+	}
+	if err := b.Send(2, 1); err == nil {
+		t.Error("Send to a bus that doesn't exist")
+	}
+	close(b.Input(in))
+	if _, err := b.Recv(in); err == nil {
+		t.Error("Recv after the host closed the input")
+	}
+}
+
+func TestReadyInterrupt(t *testing.T) {
+	code, syms, err := AssembleWithSymbols(`
+		set r4, spin
+	spin:
+		jmp r4
+	handler:
+		set r1, 0x0002 ; Bus 0 into r2
+		set r3, 0x0102 ; r2 out on bus 1
+		rbus r1
+		add r2, r2, r2
+		sbus r3
+		iret
+	`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b := NewBus(0)
+	in, out := b.Add(), b.Add()
+	if err := b.ReadyInterrupt(in, syms["handler"]); err != nil {
+		t.Fatal(err)
+	}
+	tick := make(chan time.Time)
+	close(tick)
+	p := NewProcessor(NewRAM(0x100), NewBootmedia(code, 0, 0), b, tick)
+	if err := p.Boot(); err != nil {
+		t.Fatal(err)
+	}
+	done := make(chan struct{})
+	go func() {
+		p.Run(make(chan error, 1))
+		close(done)
+	}()
+	for _, v := range []uint16{1, 20, 300} {
+		if err := b.Deliver(in, v); err != nil {
+			t.Fatal(err)
+		}
+		select {
+		case got := <-b.Output(out):
+			if got != 2*v {
+				t.Errorf("handler answered %d with %d, want %d", v, got, 2*v)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("no answer to %d", v)
+		}
+	}
+	b.Close()
+	<-done
+	if n := p.Stats().Interrupts; n != 3 {
+		t.Errorf("%d interrupts, want one per word", n)
+	}
+}
+
+func TestQueueDrops(t *testing.T) {
+	for _, tc := range []struct {
+		policy QueuePolicy
+		kept   []uint16
+	}{
+		{QueueDropOldest, []uint16{4, 5, 6}},
+		{QueueDropNewest, []uint16{1, 2, 3}},
+	} {
+		b := NewBus(0)
+		addr := b.AddQueue(3, tc.policy)
+		for v := range uint16(6) {
+			if err := b.Send(addr, v+1); err != nil {
+				t.Fatal(err)
+			}
+			if err := b.Deliver(addr, v+1); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if n := b.Dropped(addr); n != 6 {
+			t.Errorf("policy %d dropped %d, want 3 each way", tc.policy, n)
+		}
+		var out, in []uint16
+		for range 3 {
+			out = append(out, <-b.Output(addr))
+			v, err := b.Recv(addr)
+			if err != nil {
+				t.Fatal(err)
+			}
+			in = append(in, v)
+		}
+		if !slices.Equal(out, tc.kept) || !slices.Equal(in, tc.kept) {
+			t.Errorf("policy %d kept %v out and %v in, want %v", tc.policy, out, in, tc.kept)
+		}
+	}
+
+	b := NewBus(0)
+	addr := b.AddQueue(1, QueueBlock)
+	b.Send(addr, 1)
+	if err := b.Broadcast(2); err == nil {
+		t.Error("broadcast to a full blocking queue reported delivered")
+	}
+	if n := b.Dropped(addr); n != 0 {
+		t.Errorf("blocking queue counted %d drops", n)
+	}
+}
+
+func TestBroadcast(t *testing.T) {
+	code, err := Assemble(`
+		set r1, 0xff02 ; Broadcast r2
+		set r2, 0xbeef
+		sbus r1
+		setb r2, 7
+		sbusb r1
+	`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b := NewBus(2)
+	addrs := []uint8{b.Add(), b.Add(), b.Add()}
+	p := NewProcessor(NewRAM(0x100), NewBootmedia(code, 0, 0), b, nil)
+	if err := p.Boot(); err != nil {
+		t.Fatal(err)
+	}
+	steps(t, &p, 5)
+	for _, addr := range addrs {
+		for _, want := range []uint16{0xbeef, 7} {
+			select {
+			case got := <-b.Output(addr):
+				if got != want {
+					t.Errorf("bus %d got %#x, want %#x", addr, got, want)
+				}
+			default:
+				t.Errorf("bus %d missed the broadcast of %#x", addr, want)
+			}
+		}
+	}
+
+	// A Bus that isn't a BroadcastBus can't take it
+	p = NewProcessor(NewRAM(0x100), NewBootmedia(code, 0, 0), struct{ Bus }{&testBus{}}, nil)
+	if err := p.Boot(); err != nil {
+		t.Fatal(err)
+	}
+	steps(t, &p, 2)
+	if err := p.execute(); codeOf(err) != FaultBus {
+		t.Errorf("broadcast on a plain Bus gave %v, want a bus fault", err)
+	}
+}
@@ -0,0 +1,95 @@
+package emu
+
+// Cache models a direct-mapped cache in front of another Memory. It only
+// keeps hit/miss statistics; every access is still served by the inner Memory.
+type Cache struct {
+	inner    Memory
+	lineSize uint16
+	tags     []uint16
+	valid    []bool
+	hits     uint64
+	misses   uint64
+}
+
+// NewCache wraps m with a cache of the given number of lines, each lineSize bytes
+func NewCache(m Memory, lineSize, lines uint16) *Cache {
+	if lineSize == 0 {
+		lineSize = 1
+	}
+	if lines == 0 {
+		lines = 1
+	}
+	return &Cache{
+		inner:    m,
+		lineSize: lineSize,
+		tags:     make([]uint16, lines),
+		valid:    make([]bool, lines),
+	}
+}
+
+// Stats returns the number of hits and misses seen so far
+func (c *Cache) Stats() (hits, misses uint64) {
+	return c.hits, c.misses
+}
+
+// Reset invalidates every line and clears the statistics
+func (c *Cache) Reset() {
+	for i := range c.valid {
+		c.valid[i] = false
+	}
+	c.hits = 0
+	c.misses = 0
+}
+
+// touch looks up every line covered by an access of width bytes at addr
+func (c *Cache) touch(addr uint16, width uint16) {
+	first := uint32(addr) / uint32(c.lineSize)
+	last := (uint32(addr) + uint32(width) - 1) / uint32(c.lineSize)
+	for block := first; block <= last; block++ {
+		line := block % uint32(len(c.tags))
+		tag := uint16(block / uint32(len(c.tags)))
+		if c.valid[line] && c.tags[line] == tag {
+			c.hits++
+		} else {
+			c.misses++
+			c.valid[line] = true
+			c.tags[line] = tag
+		}
+	}
+}
+
+// Load8 return a byte
+func (c *Cache) Load8(addr, offset uint16) (uint8, error) {
+	data, err := c.inner.Load8(addr, offset)
+	if err == nil {
+		c.touch(addr+offset, 1)
+	}
+	return data, err
+}
+
+// Load16 returns 2 bytes
+func (c *Cache) Load16(addr, offset uint16) (uint16, error) {
+	data, err := c.inner.Load16(addr, offset)
+	if err == nil {
+		c.touch(addr+offset, 2)
+	}
+	return data, err
+}
+
+// Save8 stores a byte
+func (c *Cache) Save8(addr, offset uint16, data uint8) error {
+	err := c.inner.Save8(addr, offset, data)
+	if err == nil {
+		c.touch(addr+offset, 1)
+	}
+	return err
+}
+
+// Save16 stores 2 bytes
+func (c *Cache) Save16(addr, offset, data uint16) error {
+	err := c.inner.Save16(addr, offset, data)
+	if err == nil {
+		c.touch(addr+offset, 2)
+	}
+	return err
+}
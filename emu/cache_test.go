@@ -0,0 +1,26 @@
+package emu
+
+import "testing"
+
+func TestCacheStats(t *testing.T) {
+	c := NewCache(NewRAM(0x1000), 4, 2)
+	// Lines are 4 bytes and there are two, so 0x00 and 0x08 share line 0
+	c.Load16(0x00, 0)   // Miss, line 0 holds 0x00-0x03
+	c.Load16(0x02, 0)   // Hit
+	c.Load8(0x04, 0)    // Miss, line 1 holds 0x04-0x07
+	c.Save8(0x01, 0, 9) // Hit, stores count too
+	c.Load8(0x08, 0)    // Miss, evicts 0x00 from line 0
+	c.Load8(0x00, 0)    // Miss again
+	c.Load16(0x07, 0)   // Hit on line 1, miss on 0x08-0x0b in line 0
+	if hits, misses := c.Stats(); hits != 3 || misses != 5 {
+		t.Errorf("got %d hits %d misses, want 3 and 5", hits, misses)
+	}
+	c.Reset()
+	c.Load8(0x04, 0)
+	if hits, misses := c.Stats(); hits != 0 || misses != 1 {
+		t.Errorf("after Reset got %d hits %d misses, want 0 and 1", hits, misses)
+	}
+	if b, _ := c.Load8(0x01, 0); b != 9 {
+		t.Errorf("read back %d through the cache, want 9", b)
+	}
+}
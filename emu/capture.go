@@ -0,0 +1,99 @@
+package emu
+
+import "sync"
+
+// Control bytes in the tty protocol, shared by CaptureTTY and the
+// terminal in main
+const (
+	TTYBackspace = 0x08
+	TTYTab       = 0x09
+	TTYNewline   = 0x0a
+	TTYClear     = 0x0c // Clear the screen and home the cursor
+	TTYReturn    = 0x0d
+	TTYMove      = 0x10 // The next two bytes are the row and column, from 1
+)
+
+// CaptureTTY is a tty device that keeps what it's sent instead of drawing
+// it, so tests can check a program's output. It speaks the same protocol
+// as the terminal in main: each word is two bytes, high first, and a zero
+// byte is padding. Printable bytes, tabs and newlines are kept. Backspace
+// takes back the last byte kept and clear drops everything so far. Returns,
+// cursor moves and other control bytes leave no trace.
+type CaptureTTY struct {
+	mu   sync.Mutex
+	buf  []byte
+	move int // Argument bytes of a TTYMove still to skip
+}
+
+// Put takes one word from the tty bus
+func (c *CaptureTTY) Put(word uint16) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.putByte(byte(word >> 8))
+	c.putByte(byte(word))
+}
+
+func (c *CaptureTTY) putByte(b byte) {
+	if c.move > 0 {
+		c.move--
+		return
+	}
+	switch {
+	case b == 0:
+	case b == TTYBackspace:
+		if len(c.buf) > 0 {
+			c.buf = c.buf[:len(c.buf)-1]
+		}
+	case b == TTYTab, b == TTYNewline:
+		c.buf = append(c.buf, b)
+	case b == TTYClear:
+		c.buf = nil
+	case b == TTYMove:
+		c.move = 2
+	case b < 0x20 || b == 0x7f:
+	default:
+		c.buf = append(c.buf, b)
+	}
+}
+
+// Listen feeds everything arriving on out, the host side of a tty bus, to
+// Put until out closes or stop is called. stop takes anything already
+// buffered on out before returning, so String is complete once it has.
+func (c *CaptureTTY) Listen(out <-chan uint16) (stop func()) {
+	quit, done := make(chan struct{}), make(chan struct{})
+	go func() {
+		defer close(done)
+		for {
+			select {
+			case word, ok := <-out:
+				if !ok {
+					return
+				}
+				c.Put(word)
+			case <-quit:
+				for {
+					select {
+					case word, ok := <-out:
+						if !ok {
+							return
+						}
+						c.Put(word)
+					default:
+						return
+					}
+				}
+			}
+		}
+	}()
+	return func() {
+		close(quit)
+		<-done
+	}
+}
+
+// String returns what has been captured so far
+func (c *CaptureTTY) String() string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return string(c.buf)
+}
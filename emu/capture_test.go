@@ -0,0 +1,44 @@
+package emu
+
+import (
+	"testing"
+	"time"
+)
+
+func TestCaptureTTYHello(t *testing.T) {
+	code, err := Assemble(`
+		set r1, msg
+		set r2, end
+		set r3, loop
+		setb r6, 2
+		set r5, 0x0004 ; tty bus 0, data from r4
+	loop:
+		load r4, r1
+		sbus r5
+		add r1, r1, r6
+		ljump r1, r2, r3
+		halt
+	msg:
+		.ascii "Hello,\tworld\n\x00"
+	end:
+	`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b := NewBus(0)
+	tty := b.Add()
+	var c CaptureTTY
+	stop := c.Listen(b.Output(tty))
+	p := NewProcessor(NewRAM(0x100), NewBootmedia(code, 0, 0), b, nil)
+	if err := p.Boot(); err != nil {
+		t.Fatal(err)
+	}
+	tick := make(chan time.Time)
+	close(tick) // Free running
+	p.Ticker = tick
+	p.Run(make(chan error))
+	stop()
+	if got, want := c.String(), "Hello,\tworld\n"; got != want {
+		t.Errorf("captured %q, want %q", got, want)
+	}
+}
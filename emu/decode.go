@@ -0,0 +1,184 @@
+package emu
+
+// InstrInfo describes one decoded instruction
+type InstrInfo struct {
+	Addr   uint16
+	Opcode uint8
+	Args   [3]uint8 // Nibbles after the opcode, whatever they mean
+	Ext    uint8    // Extended instruction number, when Opcode is NOT and Args[2] != 0
+	Esc    uint8    // Escaped instruction number, when Ext is ESC
+	Arg3   uint8    // Third register of an escaped instruction
+	Width  uint16   // Bytes taken, including any immediate or trailing byte
+	HasImm bool     // There are bytes after the instruction word
+	Imm    uint16   // Those bytes as ExecuteInstruction takes them, see loadImm
+}
+
+// opWidths is how many bytes each primary instruction takes. Instructions
+// are a byte stream: the IP moves on by exactly this much unless the
+// instruction jumped. NOT's extended instructions use extWidths instead.
+var opWidths = [16]uint16{
+	LOAD:  2,
+	STORE: 2,
+	SET:   3,
+	WBUS:  1,
+	SBUS:  1,
+	RBUS:  1,
+	LJUMP: 2,
+	EJUMP: 2,
+	ADD:   2,
+	SUB:   2,
+	SHL:   2,
+	SHR:   2,
+	AND:   2,
+	OR:    2,
+	NOT:   2,
+	XOR:   2,
+}
+
+// extWidths is how many bytes each extended instruction takes
+var extWidths = map[uint8]uint16{
+	IRET:   2,
+	SMUL:   3,
+	SETB:   3,
+	MEMSET: 3,
+	MEMCPY: 3,
+	GETF:   2,
+	SETF:   2,
+	PUSH:   2,
+	POP:    2,
+	CALL:   2,
+	RET:    2,
+	PEEK:   2,
+	RLOAD:  2,
+	RSTORE: 2,
+	ESC:    3,
+}
+
+// escWidths is how many bytes each escaped instruction takes, counting the
+// instruction word and the selector byte
+var escWidths = map[uint8]uint16{
+	NAND:   3,
+	NOR:    3,
+	MUL:    4,
+	PRED:   3,
+	NEG:    3,
+	POPCNT: 3,
+	SBUSB:  3,
+	RBUSB:  3,
+	HALT:   3,
+}
+
+// escWidth looks up the width of an escaped instruction; unknown ones count
+// as 3 bytes
+func escWidth(esc uint8) uint16 {
+	if w, ok := escWidths[esc]; ok {
+		return w
+	}
+	return 3
+}
+
+// instrWidth looks up the width of an instruction. ext is NOT's third
+// nibble; unknown extended instructions count as 2 bytes. Escaped
+// instructions come back as 3, the least they take; see escWidth.
+func instrWidth(opcode, ext uint8) uint16 {
+	if opcode == NOT && ext != 0 {
+		if w, ok := extWidths[ext]; ok {
+			return w
+		}
+	}
+	return opWidths[opcode]
+}
+
+// Decode reads the instruction at addr without executing it
+func Decode(m Memory, addr uint16) (InstrInfo, error) {
+	in := InstrInfo{Addr: addr, Width: 2}
+	first, err := m.Load8(addr, 0)
+	if err != nil {
+		return in, err
+	}
+	in.Opcode = first >> 4
+	in.Args[0] = first & 0xF
+	if in.Width = opWidths[in.Opcode]; in.Width == 1 {
+		return in, nil // Single byte, don't read past it
+	}
+	second, err := m.Load8(addr, 1)
+	if err != nil {
+		return in, err
+	}
+	in.Args[1] = second >> 4
+	in.Args[2] = second & 0xF
+	if in.Opcode == NOT && in.Args[2] != 0 {
+		in.Ext = in.Args[2]
+		in.Width = instrWidth(in.Opcode, in.Ext)
+	}
+	if in.Ext == ESC {
+		sel, err := m.Load8(addr, 2)
+		if err != nil {
+			return in, err
+		}
+		in.Esc, in.Arg3 = sel&0xF, sel>>4
+		in.Width = escWidth(in.Esc)
+	}
+	if in.HasImm = in.Width > 2; in.HasImm {
+		if in.Imm, err = loadImm(m, addr, in.Opcode, in.Width); err != nil {
+			return in, err
+		}
+	}
+	return in, nil
+}
+
+// loadImm reads what follows the instruction word at addr, for an
+// instruction width bytes long: all of set's value, or the trailing bytes
+// of a longer extended or escaped instruction, high byte first and padded
+// with 0. This is the immediate execute uses, whether from memory or the
+// block cache, so tooling sees the same value.
+func loadImm(m Memory, addr uint16, opcode uint8, width uint16) (imm uint16, err error) {
+	switch {
+	case opcode == SET:
+		return m.Load16(addr, 1)
+	case width >= 3:
+		var hi, lo uint8
+		if hi, err = m.Load8(addr, 2); err == nil && width > 3 {
+			lo, err = m.Load8(addr, 3)
+		}
+		return uint16(hi)<<8 | uint16(lo), err
+	}
+	return 0, nil
+}
+
+// Instructions walks the booted image from its start IP, decoding one
+// instruction after another until the end of what Boot loaded. Nothing is
+// executed, and data laid out after the code decodes as if it were code.
+func (p *Processor) Instructions() func(yield func(InstrInfo) bool) {
+	return func(yield func(InstrInfo) bool) {
+		start, err := p.Bootmedia.GetIP()
+		if err != nil {
+			return
+		}
+		for addr := uint32(start); addr >= uint32(p.codeStart) && addr < uint32(p.codeEnd); {
+			in, err := Decode(p.Memory, uint16(addr))
+			if err != nil || !yield(in) {
+				return
+			}
+			addr += uint32(in.Width)
+		}
+	}
+}
+
+// onBoundary reports whether addr could start an instruction, mapping the
+// booted image the first time it's asked
+func (p *Processor) onBoundary(addr uint16) bool {
+	if p.bounds == nil {
+		p.bounds = []bool{}
+		p.boundStart, _ = p.Bootmedia.GetIP()
+		for in := range p.Instructions() {
+			for i := uint16(0); i < in.Width; i++ {
+				p.bounds = append(p.bounds, i == 0)
+			}
+		}
+	}
+	if addr < p.boundStart || int(addr-p.boundStart) >= len(p.bounds) {
+		return true // Not part of the image, nothing to check against
+	}
+	return p.bounds[addr-p.boundStart]
+}
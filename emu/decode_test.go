@@ -0,0 +1,132 @@
+package emu
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+)
+
+func TestInstructions(t *testing.T) {
+	// example.emu, less its header: two data bytes, then the code from 2
+	code := []uint8{
+		0x0f, 0x0a,
+		0x2b, 0x00, 0x01,
+		0x00, 0xa1,
+		0x01, 0xb1,
+		0x2c, 0x00, 0x12,
+		0x60, 0x1c,
+		0x01, 0xa1,
+		0x00, 0xb1,
+		0x82, 0x21,
+		0x90, 0x0b,
+		0x25, 0x00, 0x02,
+		0x45,
+		0x6a, 0x0c,
+		0x25, 0x02, 0x0b,
+		0x45,
+	}
+	p := NewProcessor(NewRAM(0x100), NewBootmedia(code, 0, 2), &testBus{}, nil)
+	if err := p.Boot(); err != nil {
+		t.Fatal(err)
+	}
+	var got []string
+	for in := range p.Instructions() {
+		got = append(got, fmt.Sprintf("%d:%x%x%x%x/%d", in.Addr, in.Opcode, in.Args[0], in.Args[1], in.Args[2], in.Width))
+	}
+	want := "2:2b00/3 5:00a1/2 7:01b1/2 9:2c00/3 12:601c/2 14:01a1/2 16:00b1/2 18:8221/2 " +
+		"20:900b/2 22:2500/3 25:4500/1 26:6a0c/2 28:2502/3 31:4500/1"
+	if strings.Join(got, " ") != want {
+		t.Errorf("got  %s\nwant %s", strings.Join(got, " "), want)
+	}
+}
+
+func TestEscape(t *testing.T) {
+	p := newTestProcessor(t, `
+		set r1, 0x00f0
+		nor r2, r1, r0
+		mul r4, r5, r2, r1
+		nand r3, r2, r2
+	`)
+	for _, want := range []struct {
+		addr  uint16
+		esc   uint8
+		arg3  uint8
+		width uint16
+	}{
+		{3, NOR, 0, 3},
+		{6, MUL, 2, 4},
+		{10, NAND, 2, 3},
+	} {
+		in, err := Decode(p.Memory, want.addr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if in.Opcode != NOT || in.Ext != ESC || in.Esc != want.esc || in.Arg3 != want.arg3 || in.Width != want.width {
+			t.Errorf("at %d decoded %+v, want escaped %d with third operand r%d, %d bytes", want.addr, in, want.esc, want.arg3, want.width)
+		}
+	}
+	steps(t, p, 4)
+	if r2, r3 := p.Register[2].Get16(), p.Register[3].Get16(); r2 != 0xff0f || r3 != 0x00f0 {
+		t.Errorf("nor and nand gave %#04x and %#04x, want 0xff0f and 0x00f0", r2, r3)
+	}
+	if ip := p.Register[IP].Get16(); ip != 13 {
+		t.Errorf("IP at %d after the escaped instructions, want 13", ip)
+	}
+	if got := p.stats.Escaped; got[NOR] != 1 || got[MUL] != 1 || got[NAND] != 1 || p.stats.Extended[ESC] != 3 {
+		t.Errorf("counted escaped %v, extended ESC %d", got, p.stats.Extended[ESC])
+	}
+
+	// An unused selector decodes at the shortest width and faults
+	p.Memory.Save16(13, 0, 0xe12f)
+	p.Memory.Save8(13, 2, 0x0e)
+	if in, _ := Decode(p.Memory, 13); in.Width != 3 {
+		t.Errorf("unused selector decoded %d bytes wide, want 3", in.Width)
+	}
+	if err := p.execute(); codeOf(err) != FaultInstruction {
+		t.Errorf("unused selector gave %v, want an instruction fault", err)
+	}
+}
+
+func TestDecodeMatchesExecute(t *testing.T) {
+	p := newTestProcessor(t, `
+		set r1, 0xbeef
+		set r2, 0x0001
+		setb r3, 9
+		smul r4, r5, r1, r3
+		mul r6, r7, r1, r3
+		nor r8, r1, r2
+		add r9, r1, r2
+		sbus r2
+	`)
+	// twin runs each decoded word and immediate without fetching them
+	twin := newTestProcessor(t, "nop")
+	for range 8 {
+		ip := p.Register[IP].Get16()
+		in, err := Decode(p.Memory, ip)
+		if err != nil {
+			t.Fatal(err)
+		}
+		word, _ := p.Memory.Load16(ip, 0)
+		if in.Width == 1 {
+			word &= 0xFF00
+		}
+		width, err := twin.ExecuteInstruction(word, in.Imm)
+		if err != nil {
+			t.Fatal(err)
+		}
+		steps(t, p, 1)
+		if next := p.Register[IP].Get16(); next-ip != in.Width || width != in.Width {
+			t.Errorf("at %d decoded %d bytes, execute took %d and ExecuteInstruction %d", ip, in.Width, next-ip, width)
+		}
+		if in.Opcode == SET {
+			if got := p.Register[in.Args[0]].Get16(); !in.HasImm || in.Imm != got {
+				t.Errorf("at %d decoded set immediate %#x, execute set %#x", ip, in.Imm, got)
+			}
+		}
+		for r := range IP {
+			if a, b := p.Register[r].Get16(), twin.Register[r].Get16(); a != b {
+				t.Errorf("after %d r%d is %#x executed, %#x from the decode", ip, r, a, b)
+			}
+		}
+	}
+}
@@ -0,0 +1,147 @@
+package emu
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Disasm is one disassembled instruction
+type Disasm struct {
+	Addr     uint16
+	Bytes    []uint8 // Raw encoding, immediates and trailing bytes included
+	Mnemonic string
+	Operands []string
+	Label    string // Symbol at Addr, if any
+	Target   string // Symbol matching a set immediate, likely a jump target
+}
+
+func (d Disasm) String() string {
+	out := fmt.Sprintf("%04x  % -8x  %s %s", d.Addr, d.Bytes, d.Mnemonic, strings.Join(d.Operands, ", "))
+	if d.Label != "" {
+		out = d.Label + ":\n" + out
+	}
+	if d.Target != "" {
+		out += "  ; " + d.Target
+	}
+	return out
+}
+
+// Reverse lookups of the assembler's mnemonic tables
+var (
+	opNames  = map[uint8]string{}
+	extNames = map[uint8]string{}
+	escNames = map[uint8]string{}
+)
+
+func init() {
+	for name, op := range mnemonics {
+		opNames[op] = name
+	}
+	for name, x := range extMnemonics {
+		extNames[x.op] = name
+	}
+	for name, x := range escMnemonics {
+		escNames[x.op] = name
+	}
+}
+
+// Disassemble decodes instructions from start up to, not including, end.
+// syms, as returned by AssembleWithSymbols, may be nil; otherwise it is used
+// to fill in Label and Target.
+func Disassemble(m Memory, start, end uint16, syms map[string]uint16) ([]Disasm, error) {
+	names := map[uint16]string{}
+	for name, addr := range syms {
+		if old, ok := names[addr]; !ok || name < old { // Stable pick for shared addresses
+			names[addr] = name
+		}
+	}
+	var out []Disasm
+	for addr := uint32(start); addr < uint32(end); {
+		d, err := DisassembleAt(m, uint16(addr))
+		if err != nil {
+			return out, err
+		}
+		d.Label = names[d.Addr]
+		if d.Mnemonic == "set" {
+			d.Target = names[uint16(d.Bytes[1])<<8|uint16(d.Bytes[2])]
+		}
+		out = append(out, d)
+		addr += uint32(len(d.Bytes))
+	}
+	return out, nil
+}
+
+// DisassembleAt decodes the single instruction at addr
+func DisassembleAt(m Memory, addr uint16) (Disasm, error) {
+	in, err := Decode(m, addr)
+	if err != nil {
+		return Disasm{}, err
+	}
+	d := Disasm{Addr: addr, Bytes: make([]uint8, in.Width)}
+	for i := range d.Bytes {
+		if d.Bytes[i], err = m.Load8(addr, uint16(i)); err != nil {
+			return Disasm{}, err
+		}
+	}
+	reg := func(r uint8) string { return fmt.Sprintf("r%d", r) }
+	a := in.Args
+
+	if in.Ext == ESC {
+		name, ok := escNames[in.Esc]
+		if !ok {
+			d.Mnemonic = fmt.Sprintf("esc%x", in.Esc)
+			return d, nil
+		}
+		d.Mnemonic = name
+		if in.Esc == PRED {
+			d.Operands = []string{fmt.Sprintf("%d", a[0]), fmt.Sprintf("%d", a[1])}
+			return d, nil
+		}
+		regs := []uint8{a[0], a[1], in.Arg3}
+		if len(d.Bytes) > 3 {
+			regs = append(regs, d.Bytes[3]>>4)
+		}
+		for _, r := range regs[:escMnemonics[name].regs] {
+			d.Operands = append(d.Operands, reg(r))
+		}
+		return d, nil
+	}
+	if in.Opcode == NOT && in.Ext != 0 {
+		name, ok := extNames[in.Ext]
+		if !ok {
+			d.Mnemonic = fmt.Sprintf("ext%x", in.Ext)
+			return d, nil
+		}
+		d.Mnemonic = name
+		if in.Ext == SETB {
+			d.Operands = []string{reg(a[0]), fmt.Sprintf("%d", in.Imm>>8)}
+			return d, nil
+		}
+		regs := []uint8{a[0], a[1]}
+		if len(d.Bytes) > 2 {
+			regs = append(regs, d.Bytes[2]>>4, d.Bytes[2]&0xF)
+		}
+		for _, r := range regs[:extMnemonics[name].regs] {
+			d.Operands = append(d.Operands, reg(r))
+		}
+		return d, nil
+	}
+
+	d.Mnemonic = opNames[in.Opcode]
+	switch in.Opcode {
+	case SET:
+		d.Operands = []string{reg(a[0]), fmt.Sprintf("0x%04x", in.Imm)}
+	case WBUS, SBUS, RBUS:
+		d.Operands = []string{reg(a[0])}
+	case LOAD, STORE:
+		d.Operands = []string{reg(a[0]), reg(a[1])}
+		if a[2] > 0 {
+			d.Operands = append(d.Operands, "8")
+		}
+	case NOT:
+		d.Operands = []string{reg(a[0]), reg(a[1])}
+	default:
+		d.Operands = []string{reg(a[0]), reg(a[1]), reg(a[2])}
+	}
+	return d, nil
+}
@@ -0,0 +1,36 @@
+package emu
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestDisassemble(t *testing.T) {
+	p := newTestProcessor(t, `
+	start:
+		set r1, 0x1234
+		sbus r1
+		smul r1, r2, r3, r4
+		setb r5, 200
+		set r6, start
+	`)
+	got, err := Disassemble(p.Memory, 0, 13, map[string]uint16{"start": 0})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []Disasm{
+		{Addr: 0, Bytes: []uint8{0x21, 0x12, 0x34}, Mnemonic: "set", Operands: []string{"r1", "0x1234"}, Label: "start"},
+		{Addr: 3, Bytes: []uint8{0x41}, Mnemonic: "sbus", Operands: []string{"r1"}},
+		{Addr: 4, Bytes: []uint8{0xe1, 0x22, 0x34}, Mnemonic: "smul", Operands: []string{"r1", "r2", "r3", "r4"}},
+		{Addr: 7, Bytes: []uint8{0xe5, 0x03, 0xc8}, Mnemonic: "setb", Operands: []string{"r5", "200"}},
+		{Addr: 10, Bytes: []uint8{0x26, 0x00, 0x00}, Mnemonic: "set", Operands: []string{"r6", "0x0000"}, Target: "start"},
+	}
+	if len(got) != len(want) {
+		t.Fatalf("got %d records, want %d: %v", len(got), len(want), got)
+	}
+	for i := range want {
+		if !reflect.DeepEqual(got[i], want[i]) {
+			t.Errorf("record %d is %#v, want %#v", i, got[i], want[i])
+		}
+	}
+}
@@ -1,8 +1,15 @@
 package emu
 
 import (
+	"context"
 	"errors"
 	"fmt"
+	"io"
+	"log/slog"
+	"math/bits"
+	"slices"
+	"sync"
+	"sync/atomic"
 	"time"
 )
 
@@ -26,15 +33,96 @@ const (
 	XOR
 )
 
-// Instruction pointer is reg 15
+// Extended instructions share the NOT opcode. NOT ignores its third nibble,
+// so a non-zero value there selects an extended instruction instead:
+// 0xEab0 is NOT, 0xEabx (x != 0) is extended instruction x. Those that
+// need more than two operands read them from a trailing byte.
+const (
+	_      = iota
+	IRET   // Return from an interrupt handler
+	SMUL   // Signed multiply, a * b into hi:lo (e hi lo 2, a b)
+	SETB   // Set dest to an 8 bit constant, zero extended (e dest 0 3, const)
+	MEMSET // Fill len bytes from start with value's low byte (e start len 4, value 0)
+	MEMCPY // Copy len bytes from src to dst, overlap safe (e dst src 5, len 0)
+	GETF   // Copy the flags into dest (e dest 0 6)
+	SETF   // Replace the flags with src (e src 0 7)
+	PUSH   // Push src onto the stack (e src 0 8)
+	POP    // Pop the top of the stack into dest (e dest 0 9)
+	CALL   // Push the return address and jump to target (e target 0 a)
+	RET    // Pop the return address into IP (e 0 0 b)
+	PEEK   // Like RBUS but leaves the data on the bus, present gets 1 or 0 (e spec present c)
+	RLOAD  // Copy the register numbered by index's value into dest (e dest index d)
+	RSTORE // Copy src into the register numbered by index's value (e src index e)
+	ESC    // Escape to the second bank, selected by the trailing byte (e a b f, c x)
+)
+
+// Escaped instructions are the second bank, reached through ESC once the
+// extended nibble ran out: e a b f, c y runs escaped instruction y with a
+// and b from the word and c as a third register. y = 0 is reserved. Most
+// are 3 bytes; any that need more read further operand bytes after the
+// selector, as listed in escWidths, so the bank can grow without touching
+// existing encodings.
+const (
+	_      = iota
+	NAND   // dest = ^(a & b) (e dest a f, b 1)
+	NOR    // dest = ^(a | b) (e dest a f, b 2)
+	MUL    // Unsigned multiply, a * b into hi:lo (e hi lo f, a 3, b 0)
+	PRED   // Run the next instruction only if the flags in mask equal want (e mask want f, 0 4)
+	NEG    // dest = -src, two's complement (e dest src f, 0 5)
+	POPCNT // dest = number of bits set in src (e dest src f, 0 6)
+	SBUSB  // Like SBUS but sends only the data register's low byte (e spec 0 f, 0 7)
+	RBUSB  // Like RBUS but receives a byte into the low byte, high cleared (e spec 0 f, 0 8)
+	HALT   // Stop the processor until it's reset (e 0 0 f, 0 9)
+)
+
+// Flag bits. Z, C, N, V and P are set by the arithmetic and logic
+// instructions, E by WBUS.
+const (
+	FlagZ = 1 << iota // Result was zero
+	FlagC             // Carry out of ADD, borrow from SUB
+	FlagN             // Top bit of the result is set
+	FlagV             // Signed overflow from ADD or SUB
+	FlagE             // WBUS found no bus with data waiting
+	FlagP             // Result has an even number of bits set
+)
+
+// Instruction pointer is reg 15, stack pointer is reg 14.
+// The stack grows down, SP points at the last word pushed.
 const (
 	IP = 15
+	SP = 14
+)
+
+// SBUS to this bus address goes to every subscribed bus at once, if the
+// Bus is a BroadcastBus. It's a bus fault otherwise.
+const (
+	BROADCAST = 0xFF
+)
+
+// RBUS from this bus address reads the low 16 bits of the instruction
+// counter instead of going to a device. Wraparound is fine for deltas.
+const (
+	CYCLES = 0xFE
+)
+
+// RBUS from this bus address, inside an interrupt handler, reads the
+// address of the bus that raised the interrupt, so one handler can serve
+// several devices
+const (
+	INTSOURCE = 0xFD
+)
+
+// EOF is what an input bus delivers once its source is exhausted. Input
+// devices send one byte per word, so real data can't be mistaken for it.
+const (
+	EOF = 0xFFFF
 )
 
 // Interrupt is used to force the processor to run an alternate code segment
 type Interrupt struct {
 	BusAddr uint8  // Which bus sent the interrupt
 	Handler uint16 // What address contains the code to handle event
+	Reset   bool   // Warm reset the processor instead of running a handler
 }
 
 // Register represents CPU internal storage
@@ -54,16 +142,160 @@ func (r *Register) Get16() uint16 {
 	return uint16(r.High)<<8 | uint16(r.Low)
 }
 
+// Hook is called around each instruction with the address it was fetched
+// from, its opcode and the three argument nibbles
+type Hook func(ip uint16, opcode uint8, args [3]uint8)
+
 // Processor represents the core of this whole machine! :D
 type Processor struct {
 	Register [16]Register
+	Flags    uint16
 	Memory
 	Bootmedia
 	Bus
 	Ticker <-chan time.Time
 	Ints   <-chan Interrupt
+
+	// Coalesce collapses interrupts from a bus that already has one pending,
+	// so a fast device can't queue up more handler runs than it gets serviced.
+	Coalesce bool
+
+	// StallLimit is how many executions in a row may leave the IP where it
+	// was before Run reports the processor as stuck. Zero disables the check.
+	StallLimit int
+
+	// StepLimit caps how many instructions RunUntil will execute looking
+	// for its target. Zero means DefaultStepLimit.
+	StepLimit int
+
+	// GuardCode makes STORE into the region written by Boot an error, to
+	// catch data writes that clobber the program itself.
+	GuardCode bool
+
+	// RegisterLimit is how many registers, counting up from 0, programs may
+	// use. Anything above traps, except IP which is always usable. Zero
+	// allows all 16.
+	RegisterLimit int
+
+	// Saturate makes ADD and SUB clamp to 0xFFFF and 0x0000 instead of
+	// wrapping. The carry flag still reports when that happened.
+	Saturate bool
+
+	// Strict traps operations whose result is probably a bug: shifting by
+	// 16 or more, which always gives 0, and SUB going below zero. Neither
+	// writes its result. Strict wins over Saturate.
+	Strict bool
+
+	// Verbose, when set, gets the register table redrawn after every
+	// instruction, using ANSI cursor positioning to keep it in one place,
+	// formatted by VerboseFormat.
+	Verbose       io.Writer
+	VerboseFormat RegisterFormat
+
+	// TrapIPOverflow makes an instruction that ends at the top of memory
+	// trap instead of letting the IP wrap around to 0, to catch a program
+	// running off the end of the address space. Jumps to low addresses are
+	// unaffected.
+	TrapIPOverflow bool
+
+	// StackLimit is the lowest address the stack may grow down to, the top
+	// of the heap. PUSH and CALL trap instead of writing below it. Zero
+	// means no limit.
+	StackLimit uint16
+
+	// BeforeExec and AfterExec, when set, are called around every
+	// instruction. AfterExec is skipped when a register check traps the
+	// instruction before it runs, but still called if the operation fails.
+	BeforeExec Hook
+	AfterExec  Hook
+
+	// OnCall, when set, gets an event for every CALL, RET, interrupt
+	// dispatch and IRET, enough to build a call tree.
+	OnCall func(CallEvent)
+
+	// OnSend, when set, is called with the bus address and data each time
+	// SBUS delivers something, after the bus has taken it. Broadcasts come
+	// with the address BROADCAST. It runs on the processor's goroutine, so
+	// it holds up the program while it runs.
+	OnSend func(bus uint8, data uint16)
+
+	// CheckBoundaries traps when the IP lands somewhere other than the start
+	// of an instruction in the booted image. Boundaries come from decoding
+	// the image from its start IP, the same walk as Instructions, so data
+	// mixed in with the code can throw them off. Addresses outside that
+	// walk aren't checked.
+	CheckBoundaries bool
+
+	// BlockCache keeps instructions decoded, a straight line run at a time,
+	// instead of reading each one from memory every time it runs, for speed
+	// in hot loops (BenchmarkBlockCache). It costs about 2.5KB for each 256
+	// bytes of address space code runs from. Results are the same, though
+	// RunStats counts fewer memory reads. Stores made by the program drop
+	// what they overwrite; memory changed behind the processor's back, by
+	// the host, a Scrubber, a bank switch or a RegisterWindow, needs
+	// FlushBlocks.
+	BlockCache bool
+
+	// TrackCoverage records the address of every instruction executed, for
+	// Coverage. Boot clears the record.
+	TrackCoverage bool
+
+	// Logger, when set, gets boot, reset, interrupt, error and halt events.
+	// Nothing is logged without one.
+	Logger *slog.Logger
+
+	// UseResetVector makes Boot and WarmReset, and so reset interrupts,
+	// start at the address stored in the word at ResetVector, letting
+	// firmware choose where a restart goes. While that word is 0, or
+	// either it or the address it holds is outside memory, the
+	// bootmedia's start IP is used as usual.
+	UseResetVector bool
+	ResetVector    uint16
+
+	// BusTimeout, when set, reports an SBUS or RBUS that has been blocked
+	// this long to the Logger and OnBusBlocked, which is called from
+	// another goroutine. The transfer keeps waiting: a Recv can't be called
+	// off without losing the word it would have read. Zero disables the
+	// check.
+	BusTimeout   time.Duration
+	OnBusBlocked func(BusBlock)
+
+	pending    []Interrupt // Raised but not yet dispatched
+	servicing  bool        // A handler is running
+	saved      intContext  // What the running handler interrupted
+	prefixed   bool        // PRED passed; hold interrupts until the next instruction runs
+	halted     bool        // HALT ran, nothing more executes until a reset
+	stalls     int         // Consecutive executions that didn't move the IP
+	codeStart  uint16      // First address written by Boot
+	codeEnd    uint16      // One past the last address written by Boot
+	imm        uint16      // Stands in for the bytes after the instruction, see ExecuteInstruction
+	hasImm     bool        // imm is in use
+	bounds     []bool      // Instruction starts from boundStart on, built when first needed
+	boundStart uint16
+	covered    []bool      // Instruction starts executed, indexed by address
+	blocks     *blockTable // The block cache
+	stats      RunStats
+	mu         sync.Mutex        // Held by Run while it changes state, see LoadProgram
+	dropped    *atomic.Uint64    // Shared with relayInts, which outlives copies of Processor
+	images     map[int]bankImage // What BootBank put in each bank
+	cycles     uint64            // Instructions executed since the processor was made
 }
 
+// Fault codes carried by ProcError, so hosts can tell a misbehaving device
+// from a bad memory access or a broken program
+const (
+	FaultUnknown     = iota
+	FaultMemory      // Load, store or fetch failed or was refused
+	FaultBus         // A bus transfer failed
+	FaultRegister    // Register argument out of range
+	FaultInstruction // Not an instruction we know
+	FaultBoot        // Couldn't load the boot image
+	FaultStall       // IP stopped advancing
+	FaultInterrupt   // Interrupt handling misused
+	FaultStack       // Stack grew into the heap
+	FaultStrict      // Questionable operation trapped by Strict
+)
+
 // ProcError used to return errors
 type ProcError struct {
 	msg    string
@@ -82,6 +314,44 @@ func (pe ProcError) Error() string {
 	return out
 }
 
+// Code returns the Fault code for the error
+func (pe ProcError) Code() int {
+	return pe.code
+}
+
+// Unwrap returns the error from the Memory or Bus that caused this one, if any
+func (pe ProcError) Unwrap() error {
+	return pe.orig
+}
+
+// BootError is returned when Boot fails part way through the image
+type BootError struct {
+	ProcError
+	Loaded uint16 // Bytes written to memory before the failure
+}
+
+func (be BootError) Error() string {
+	return fmt.Sprintf("%s\n[loaded] %d bytes", be.ProcError.Error(), be.Loaded)
+}
+
+// Unwrap gives access to the ProcError, and through it the original error
+func (be BootError) Unwrap() error {
+	return be.ProcError
+}
+
+// fault turns an error from a Memory or Bus into a ProcError with the given
+// code. ProcErrors already carry their own code and pass through untouched.
+func fault(code int, addr uint16, err error) error {
+	if _, ok := err.(ProcError); ok || err == nil {
+		return err
+	}
+	msg := "Memory fault"
+	if code == FaultBus {
+		msg = "Bus fault"
+	}
+	return ProcError{msg, code, addr, 0, nil, err}
+}
+
 // Memory loads and saves data
 type Memory interface {
 	Load8(address, offset uint16) (uint8, error)
@@ -90,6 +360,16 @@ type Memory interface {
 	Save16(address, offset, data uint16) error
 }
 
+// BankedMemory is Memory split into equally sized banks, of which only the
+// selected one is visible to loads and saves
+type BankedMemory interface {
+	Memory
+	Banks() int
+	BankSize() uint16
+	Bank() int
+	SelectBank(bank int) error
+}
+
 // Bootmedia is the initial source of instructions
 type Bootmedia interface {
 	GetOffset() (uint16, error)
@@ -98,6 +378,45 @@ type Bootmedia interface {
 	GetIP() (uint16, error)
 }
 
+// Segment is one piece of a segmented boot image, bound for a bank
+type Segment struct {
+	Bank   int
+	Offset uint16
+	Data   []uint8
+}
+
+// SegmentedBootmedia is Bootmedia whose image is split into segments that
+// Boot places into separate banks, so images can be larger than 64K
+type SegmentedBootmedia interface {
+	Bootmedia
+	Segments() ([]Segment, error)
+	StartBank() (int, error) // Bank selected when execution starts
+}
+
+// StackBootmedia is Bootmedia that also says where the stack starts. Boot
+// loads it into SP; without it SP starts at the top of memory.
+type StackBootmedia interface {
+	Bootmedia
+	GetSP() (uint16, error)
+}
+
+// RegisterBootmedia is Bootmedia that pre-seeds registers. Boot and
+// WarmReset load them after the IP and SP, so a seeded SP wins; seeding the
+// IP is an error.
+type RegisterBootmedia interface {
+	Bootmedia
+	GetRegisters() (map[uint8]uint16, error)
+}
+
+// RelocatableBootmedia is Bootmedia for a program built to load at 0. Each
+// relocation is a position in the image, like the addresses Load takes,
+// of a big endian word holding an address; Boot adds the load offset to
+// it once the image is in memory.
+type RelocatableBootmedia interface {
+	Bootmedia
+	Relocations() ([]uint16, error)
+}
+
 // Bus is a general purpose interface for interacting with the processor
 // busses 0 - 5 planned for normal use
 // bus 15 reserved for signalling
@@ -108,16 +427,144 @@ type Bus interface {
 	Interrupts(chan<- Interrupt)
 }
 
+// BroadcastBus is a Bus that can put one word on all its busses at once,
+// which SBUS to BROADCAST needs
+type BroadcastBus interface {
+	Bus
+	Broadcast(data uint16) error
+}
+
+// PeekBus is a Bus that can show the next value waiting on a bus without
+// taking it, so the following Recv still gets it
+type PeekBus interface {
+	Bus
+	Peek(busaddr uint8) (uint16, bool) // false when nothing is waiting
+}
+
+// ByteBus is a Bus that knows about byte wide transfers, for devices that
+// deal in bytes. Without it SBUSB and RBUSB fall back on Send and Recv,
+// sending the byte as a word with a zero high byte and dropping the high
+// byte of the word received.
+type ByteBus interface {
+	Bus
+	Send8(busaddr, data uint8) error
+	Recv8(busaddr uint8) (uint8, error)
+}
+
+// OutputBus is a Bus whose output the host can read from a chan per bus,
+// which is what RunWithHandlers needs. Output returns nil for a bus that
+// doesn't exist.
+type OutputBus interface {
+	Bus
+	Output(busaddr uint8) <-chan uint16
+}
+
+// IntPolicy says what happens to an interrupt raised while the interrupt
+// chan is full
+type IntPolicy int
+
+// Interrupt chan full policies
+const (
+	IntBlock      IntPolicy = iota // The device waits for room
+	IntDropOldest                  // The oldest queued interrupt is discarded to make room
+	IntDropNewest                  // The new interrupt is discarded
+)
+
+// ProcessorOptions changes how NewProcessor wires up interrupts. The zero
+// value gives an unbuffered chan that blocks devices until Run takes the
+// interrupt.
+type ProcessorOptions struct {
+	IntBuffer int       // How many interrupts can wait for Run
+	IntFull   IntPolicy // What to do once IntBuffer are waiting
+}
+
 // NewProcessor - Basically just filling the struct for you.
-func NewProcessor(m Memory, boot Bootmedia, bus Bus, t <-chan time.Time) Processor {
+func NewProcessor(m Memory, boot Bootmedia, bus Bus, t <-chan time.Time, opts ...ProcessorOptions) Processor {
+	var o ProcessorOptions
+	if len(opts) > 0 {
+		o = opts[0]
+	}
 	regs := [16]Register{}
-	ints := make(chan Interrupt)
-	bus.Interrupts(ints) // Give all busses our interrupt chan
-	return Processor{regs, m, boot, bus, t, ints}
+	ints := make(chan Interrupt, o.IntBuffer)
+	dropped := new(atomic.Uint64)
+	if o.IntFull == IntBlock {
+		bus.Interrupts(ints) // Give all busses our interrupt chan
+	} else {
+		// Devices never block; relayInts applies the policy on their behalf
+		in := make(chan Interrupt)
+		go relayInts(in, ints, o.IntFull, dropped)
+		bus.Interrupts(in)
+	}
+	return Processor{
+		Register:  regs,
+		Memory:    m,
+		Bootmedia: boot,
+		Bus:       bus,
+		Ticker:    t,
+		Ints:      ints,
+		dropped:   dropped,
+	}
+}
+
+// relayInts moves interrupts from devices to Run, dropping one whenever
+// out is full. Closing in closes out.
+func relayInts(in <-chan Interrupt, out chan Interrupt, policy IntPolicy, dropped *atomic.Uint64) {
+	defer close(out)
+Relay:
+	for i := range in {
+		for {
+			select {
+			case out <- i:
+				continue Relay
+			default:
+			}
+			if policy == IntDropNewest {
+				dropped.Add(1)
+				continue Relay
+			}
+			select {
+			case <-out:
+				dropped.Add(1)
+			default: // Run took one meanwhile, there's room now
+			}
+		}
+	}
+}
+
+// IntsDropped is how many interrupts a drop policy has discarded
+func (p *Processor) IntsDropped() uint64 {
+	if p.dropped == nil {
+		return 0
+	}
+	return p.dropped.Load()
+}
+
+// BootOptions changes how Boot loads the image. The zero value loads all of
+// it. Options are ignored for SegmentedBootmedia, which always loads whole.
+type BootOptions struct {
+	Progress func(loaded, total uint16) // Called after each byte is written
+	Start    uint16                     // First bootmedia byte to load
+	End      uint16                     // Stop before this byte, 0 loads to the end
 }
 
 // Boot loads data from Bootmedia
-func (p *Processor) Boot() error {
+func (p *Processor) Boot(opts ...BootOptions) (err error) {
+	defer func() {
+		if err != nil {
+			p.log(slog.LevelError, "Boot failed", "error", err)
+		} else {
+			p.log(slog.LevelInfo, "Booted", "ip", p.Register[IP].Get16(), "start", p.codeStart, "end", p.codeEnd)
+		}
+	}()
+	var o BootOptions
+	if len(opts) > 0 {
+		o = opts[0]
+	}
+	p.blocks = nil // Even a failed boot may have changed memory
+	p.halted = false
+	if sb, ok := p.Bootmedia.(SegmentedBootmedia); ok {
+		return p.bootSegments(sb)
+	}
 	offset, err := p.Bootmedia.GetOffset()
 	if err != nil {
 		return errors.New("Failed to load offset from bootmedia")
@@ -126,94 +573,794 @@ func (p *Processor) Boot() error {
 	if err != nil {
 		return errors.New("Failed to load length from bootmedia")
 	}
-	for addr := uint16(0); addr < length; addr++ {
+	size := length
+	if o.End != 0 && o.End < length {
+		length = o.End
+	}
+	if o.Start > length {
+		return fmt.Errorf("Boot range %x - %x is outside of bootmedia", o.Start, length)
+	}
+	for addr := o.Start; addr < length; addr++ {
 		data, err := p.Bootmedia.Load(addr)
 		if err != nil {
-			return ProcError{"Failed to load data from bootmedia", 0, addr, offset, nil, err}
+			pe := ProcError{"Failed to load data from bootmedia", FaultBoot, addr, offset, nil, err}
+			return BootError{pe, addr - o.Start}
 		}
 		err = p.Memory.Save8(addr, offset, data)
 		if err != nil {
-			return ProcError{"Failed to save data to memory", 0, addr, offset, []uint8{data}, err}
+			pe := ProcError{"Failed to save data to memory", FaultBoot, addr, offset, []uint8{data}, err}
+			return BootError{pe, addr - o.Start}
+		}
+		if o.Progress != nil {
+			o.Progress(addr-o.Start+1, length-o.Start)
 		}
 	}
-	ip, err := p.Bootmedia.GetIP() // Get initial instruction pointer
+	if rb, ok := p.Bootmedia.(RelocatableBootmedia); ok {
+		if err := p.relocate(rb, offset, size, o.Start, length); err != nil {
+			return err
+		}
+	}
+	p.codeStart = offset + o.Start
+	p.codeEnd = offset + length
+	p.bounds = nil
+	p.covered = nil
+	ip, err := p.startIP() // Get initial instruction pointer
 	if err != nil {
-		return fmt.Errorf("Could not set initial Instruction Pointer: " + err.Error())
+		return fmt.Errorf("Could not set initial Instruction Pointer: %s", err)
 	}
 	p.Register[IP].Put16(ip)
+	return p.initRegisters()
+}
+
+// relocate adds offset to each relocated word Boot loaded, the image
+// positions from up to to. Relocations outside that range are left for the
+// Boot that loads them, but any past the end of the image, size bytes, are
+// an error.
+func (p *Processor) relocate(rb RelocatableBootmedia, offset, size, from, to uint16) error {
+	relocs, err := rb.Relocations()
+	if err != nil {
+		return fmt.Errorf("Failed to load relocations from bootmedia: %s", err)
+	}
+	for _, at := range relocs {
+		if uint32(at)+2 > uint32(size) {
+			return ProcError{"Relocation outside of bootmedia", FaultBoot, at, offset, nil, nil}
+		}
+		if at < from || at+2 > to {
+			continue
+		}
+		v, err := p.Memory.Load16(at, offset)
+		if err == nil {
+			err = p.Memory.Save16(at, offset, v+offset)
+		}
+		if err != nil {
+			return ProcError{"Failed to relocate", FaultBoot, at, offset, nil, err}
+		}
+	}
+	return nil
+}
+
+// bootSegments loads every segment into its bank, then selects the start
+// bank. Without BankedMemory every segment has to be for bank 0.
+func (p *Processor) bootSegments(sb SegmentedBootmedia) error {
+	segs, err := sb.Segments()
+	if err != nil {
+		return fmt.Errorf("Failed to load segments from bootmedia: %s", err)
+	}
+	start, err := sb.StartBank()
+	if err != nil {
+		return fmt.Errorf("Failed to load start bank from bootmedia: %s", err)
+	}
+	bm, banked := p.Memory.(BankedMemory)
+	for i, seg := range segs {
+		if !banked && seg.Bank != 0 {
+			return fmt.Errorf("Segment %d is for bank %d, but memory isn't banked", i, seg.Bank)
+		}
+		if banked {
+			if err := bm.SelectBank(seg.Bank); err != nil {
+				return ProcError{"Failed to select bank for segment", FaultBoot, 0, seg.Offset, []uint8{uint8(i)}, err}
+			}
+			if uint32(seg.Offset)+uint32(len(seg.Data)) > uint32(bm.BankSize()) {
+				return ProcError{"Segment doesn't fit in its bank", FaultBoot, uint16(len(seg.Data)), seg.Offset, []uint8{uint8(i)}, nil}
+			}
+		}
+		for addr, data := range seg.Data {
+			if err := p.Memory.Save8(uint16(addr), seg.Offset, data); err != nil {
+				pe := ProcError{"Failed to save data to memory", FaultBoot, uint16(addr), seg.Offset, []uint8{data}, err}
+				return BootError{pe, uint16(addr)}
+			}
+		}
+		if seg.Bank == start {
+			p.codeStart = seg.Offset
+			p.codeEnd = seg.Offset + uint16(len(seg.Data))
+			p.bounds = nil
+		}
+	}
+	p.covered = nil
+	if banked {
+		if err := bm.SelectBank(start); err != nil {
+			return fmt.Errorf("Failed to select start bank: %s", err)
+		}
+	}
+	ip, err := p.startIP()
+	if err != nil {
+		return fmt.Errorf("Could not set initial Instruction Pointer: %s", err)
+	}
+	p.Register[IP].Put16(ip)
+	return p.initRegisters()
+}
+
+// WarmReset restarts from the bootmedia's start IP, or the reset vector
+// with UseResetVector, without reloading the image, so memory keeps
+// whatever the last run left in it. Registers are cleared and any pending
+// interrupts are dropped.
+func (p *Processor) WarmReset() error {
+	ip, err := p.startIP()
+	if err != nil {
+		return fmt.Errorf("Could not set initial Instruction Pointer: %s", err)
+	}
+	p.Register = [16]Register{}
+	p.Flags = 0
+	p.pending = nil
+	p.servicing = false
+	p.prefixed = false
+	p.halted = false
+	p.stalls = 0
+	p.Register[IP].Put16(ip)
+	p.log(slog.LevelInfo, "Warm reset", "ip", ip)
+	return p.initRegisters()
+}
+
+// startIP is where execution begins after Boot or WarmReset: the word at
+// ResetVector when UseResetVector is set and the word is a readable address
+// other than 0, otherwise the bootmedia's start IP
+func (p *Processor) startIP() (uint16, error) {
+	if p.UseResetVector {
+		ip, err := p.Memory.Load16(p.ResetVector, 0)
+		if err == nil && ip != 0 {
+			if _, err = p.Memory.Load8(ip, 0); err == nil {
+				return ip, nil
+			}
+		}
+		if err != nil {
+			p.log(slog.LevelWarn, "Invalid reset vector", "vector", p.ResetVector, "error", err)
+		}
+	}
+	return p.Bootmedia.GetIP()
+}
+
+// initRegisters sets the stack pointer, then any registers the bootmedia
+// seeds
+func (p *Processor) initRegisters() error {
+	if err := p.initSP(); err != nil {
+		return err
+	}
+	rb, ok := p.Bootmedia.(RegisterBootmedia)
+	if !ok {
+		return nil
+	}
+	regs, err := rb.GetRegisters()
+	if err != nil {
+		return fmt.Errorf("Could not seed registers: %s", err)
+	}
+	for r, v := range regs {
+		if r >= IP {
+			return ProcError{"Bootmedia seeds a register it can't", FaultBoot, 0, 0, []uint8{r}, nil}
+		}
+		p.Register[r].Put16(v)
+	}
+	return nil
+}
+
+// initSP sets the stack pointer from StackBootmedia, or else to the top of
+// memory: the end of a bank for BankedMemory, otherwise 0 so the first push
+// wraps to the top of the 64K address space.
+func (p *Processor) initSP() error {
+	var sp uint16
+	if sb, ok := p.Bootmedia.(StackBootmedia); ok {
+		var err error
+		if sp, err = sb.GetSP(); err != nil {
+			return fmt.Errorf("Could not set initial Stack Pointer: %s", err)
+		}
+	} else if bm, ok := p.Memory.(BankedMemory); ok {
+		sp = bm.BankSize()
+	}
+	p.Register[SP].Put16(sp)
+	return nil
+}
+
+// LoadProgram boots a new image into the existing memory and warm resets
+// onto it. It's safe to call while Run is going; the swap happens between
+// instructions and Run carries on with the new program. If booting fails
+// part way, memory holds a mix of the two images.
+func (p *Processor) LoadProgram(bm Bootmedia) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.Bootmedia = bm
+	if err := p.Boot(); err != nil {
+		return err
+	}
+	return p.WarmReset()
+}
+
+// bankImage remembers a BootBank so RunBank can start it
+type bankImage struct {
+	boot               Bootmedia
+	codeStart, codeEnd uint16
+}
+
+// BootBank loads bm into one bank of BankedMemory, leaving the other banks,
+// the selected bank and the registers as they were. Call it once per
+// firmware image, then RunBank to pick which one runs.
+func (p *Processor) BootBank(bank int, bm Bootmedia, opts ...BootOptions) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	mem, ok := p.Memory.(BankedMemory)
+	if !ok {
+		return errors.New("BootBank needs banked memory")
+	}
+	prev := mem.Bank()
+	if err := mem.SelectBank(bank); err != nil {
+		return fmt.Errorf("Failed to select bank %d: %s", bank, err)
+	}
+	defer mem.SelectBank(prev)
+
+	regs, boot, start, end := p.Register, p.Bootmedia, p.codeStart, p.codeEnd
+	defer func() {
+		p.Register, p.Bootmedia, p.codeStart, p.codeEnd = regs, boot, start, end
+		p.bounds = nil
+	}()
+	p.Bootmedia = bm
+	if err := p.Boot(opts...); err != nil {
+		return err
+	}
+	if p.images == nil {
+		p.images = map[int]bankImage{}
+	}
+	p.images[bank] = bankImage{bm, p.codeStart, p.codeEnd}
 	return nil
 }
 
-// Run does what you'd expect
+// RunBank selects a bank loaded by BootBank and warm resets onto its image,
+// so execution carries on from that image's start IP
+func (p *Processor) RunBank(bank int) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	img, ok := p.images[bank]
+	if !ok {
+		return fmt.Errorf("Nothing booted into bank %d", bank)
+	}
+	mem, ok := p.Memory.(BankedMemory)
+	if !ok {
+		return errors.New("RunBank needs banked memory")
+	}
+	if err := mem.SelectBank(bank); err != nil {
+		return fmt.Errorf("Failed to select bank %d: %s", bank, err)
+	}
+	p.Bootmedia, p.codeStart, p.codeEnd = img.boot, img.codeStart, img.codeEnd
+	p.bounds = nil
+	p.blocks = nil
+	return p.WarmReset()
+}
+
+// Cycles is how many instructions have run since the processor was made,
+// the counter guest code reads through the CYCLES bus address
+func (p *Processor) Cycles() uint64 {
+	return p.cycles
+}
+
+// SaveRegisters captures the register file, IP included, but not memory
+func (p *Processor) SaveRegisters() (regs [16]uint16) {
+	for i := range p.Register {
+		regs[i] = p.Register[i].Get16()
+	}
+	return
+}
+
+// Registers is a snapshot of every register's value, the IP at index 15,
+// for dumps and state export. It's SaveRegisters taken under the
+// processor's lock, so it can be called while Run is going, though not from
+// a hook.
+func (p *Processor) Registers() [16]uint16 {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.SaveRegisters()
+}
+
+// RestoreRegisters puts back a register file captured by SaveRegisters
+func (p *Processor) RestoreRegisters(regs [16]uint16) {
+	for i := range p.Register {
+		p.Register[i].Put16(regs[i])
+	}
+}
+
+// Run does what you'd expect. Errors go to errorChan; while one is waiting
+// to be read the processor stops executing but still takes interrupts, so
+// closing the interrupt chan always shuts it down, even if nobody reads.
+// It also returns once the program runs HALT.
 func (p *Processor) Run(errorChan chan error) {
+	p.mu.Lock()
+	p.stats = RunStats{} // Under the lock, Interrupt may be counting already
+	p.mu.Unlock()
+	began := time.Now()
+	defer func() {
+		p.mu.Lock()
+		defer p.mu.Unlock()
+		p.stats.Elapsed = time.Since(began)
+		p.log(slog.LevelInfo, "Halted", "ip", p.Register[IP].Get16())
+	}()
 	for {
-		// fmt.Printf("\nIP: %x\n0:%x\n1:%x", p.Register[IP].Get16(), p.Register[0].Get16(), p.Register[1].Get16())
-		/*fmt.Printf("\033[5;1H")
-		fmt.Printf("========== \n")*/
+		p.mu.Lock()
 		err := p.execute()
-		/*for i := 0; i < 16; i++ {
-			fmt.Printf("0x%x 0x%x      \n", i, p.Register[i].Get16())
-		}*/
-		if err != nil {
-			errorChan <- err
+		if p.Verbose != nil {
+			p.drawRegisters()
+		}
+		halted := p.halted
+		p.mu.Unlock()
+		if halted {
+			return // Anything execute said was about being halted already
+		}
+		if err != nil && !p.report(errorChan, err) {
+			return
 		}
 		select {
 		case <-p.Ticker:
-		case <-p.Ints:
-			return
+		case i, ok := <-p.Ints:
+			if !ok {
+				return // Interrupt chan closed, time to shut down
+			}
+			if err := p.take(i); err != nil && !p.report(errorChan, err) {
+				return
+			}
+		}
+	}
+}
+
+// RunWithHandlers runs the processor like Run while feeding everything
+// sent on each bus in handlers to its handler, so an embedding host doesn't
+// need its own select loop over the busses. The bus must be an OutputBus.
+// Each bus is drained on its own goroutine, so handlers for different
+// busses can run at once; a handler should close the interrupt chan (with
+// the bus's Close, say) when the program is finished. Output already sent
+// is handed over before RunWithHandlers returns.
+func (p *Processor) RunWithHandlers(handlers map[uint8]func(uint16), errorChan chan error) error {
+	ob, ok := p.Bus.(OutputBus)
+	if !ok {
+		return errors.New("Bus has no output chans")
+	}
+	outs := make(map[uint8]<-chan uint16, len(handlers))
+	for addr := range handlers {
+		if outs[addr] = ob.Output(addr); outs[addr] == nil {
+			return fmt.Errorf("Handler for bus %d, which doesn't exist", addr)
+		}
+	}
+	quit := make(chan struct{})
+	var wg sync.WaitGroup
+	for addr, handle := range handlers {
+		wg.Add(1)
+		go func(out <-chan uint16, handle func(uint16)) {
+			defer wg.Done()
+			for {
+				select {
+				case data, ok := <-out:
+					if !ok {
+						return
+					}
+					handle(data)
+				case <-quit:
+					for {
+						select {
+						case data, ok := <-out:
+							if !ok {
+								return
+							}
+							handle(data)
+						default:
+							return
+						}
+					}
+				}
+			}
+		}(outs[addr], handle)
+	}
+	p.Run(errorChan)
+	close(quit)
+	wg.Wait()
+	return nil
+}
+
+// Halted reports whether the processor has run HALT since it was last
+// booted or reset. Run returns once it does.
+func (p *Processor) Halted() bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.halted
+}
+
+// Coverage reports which addresses instructions have been executed from
+// since Boot, indexed by address, to find code a program never reached.
+// Only the first byte of each instruction is marked. It's nil unless
+// TrackCoverage is set and something has run.
+func (p *Processor) Coverage() []bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return slices.Clone(p.covered)
+}
+
+// StepInfo reports where Step's instruction was and where the next one is
+type StepInfo struct {
+	IP   uint16 // Address of the instruction executed
+	Next uint16 // Address the next fetch will read, after any jump
+}
+
+// Step executes the instruction at the IP and reports the IP it leaves
+// behind, so tooling can decode the next instruction before it runs. The
+// Ticker and interrupts are left alone. If the instruction fails, Next is
+// wherever the IP was left.
+func (p *Processor) Step() (StepInfo, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	s := StepInfo{IP: p.Register[IP].Get16()}
+	err := p.execute()
+	s.Next = p.Register[IP].Get16()
+	return s, err
+}
+
+// DefaultStepLimit is RunUntil's step limit when StepLimit isn't set
+const DefaultStepLimit = 1 << 20
+
+// RunUntil executes instructions back to back, ignoring the Ticker, until
+// the IP reaches target. It always executes at least one, so it can be
+// used to go round a loop back to where it is. Interrupts waiting on the
+// chan are taken between instructions. It stops early on an error, when
+// the interrupt chan closes, or after StepLimit instructions.
+func (p *Processor) RunUntil(target uint16) error {
+	limit := p.StepLimit
+	if limit <= 0 {
+		limit = DefaultStepLimit
+	}
+	for n := 0; n < limit; n++ {
+		s, err := p.Step()
+		if err != nil {
+			return err
+		}
+		if s.Next == target {
+			return nil
+		}
+		if p.halted {
+			return errors.New("Halted before reaching target")
+		}
+		select {
+		case i, ok := <-p.Ints:
+			if !ok {
+				return errors.New("Interrupts closed before reaching target")
+			}
+			if err := p.take(i); err != nil {
+				return err
+			}
+		default:
+		}
+	}
+	return ProcError{"Step limit reached before target", FaultStall, p.Register[IP].Get16(), 0, []uint8{uint8(target >> 8), uint8(target)}, nil}
+}
+
+// report blocks until errorChan takes err, handling interrupts meanwhile.
+// It returns false if the interrupt chan closed first.
+func (p *Processor) report(errorChan chan error, err error) bool {
+	for {
+		select {
+		case errorChan <- err:
+			return true
+		case i, ok := <-p.Ints:
+			if !ok {
+				p.log(slog.LevelWarn, "Error not delivered", "error", err)
+				return false
+			}
+			if e := p.take(i); e != nil {
+				p.log(slog.LevelError, "Error not delivered", "error", e) // Still stuck on err
+			}
 		}
 	}
 }
 
+// Interrupt injects i as if a device had raised it, for tests and tools
+// that have no device to raise it from. It takes the same path as
+// interrupts from the chan, between instructions if Run is going, and
+// doesn't need Run at all.
+func (p *Processor) Interrupt(i Interrupt) error {
+	return p.take(i)
+}
+
+// take acts on an interrupt from the chan
+func (p *Processor) take(i Interrupt) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if i.Reset {
+		p.log(slog.LevelWarn, "Reset by interrupt", "bus", i.BusAddr)
+		return p.WarmReset()
+	}
+	p.raise(i)
+	return nil
+}
+
+// raise queues an interrupt and dispatches it if no handler is running
+func (p *Processor) raise(i Interrupt) {
+	if p.Coalesce {
+		for _, q := range p.pending {
+			if q.BusAddr == i.BusAddr {
+				p.log(slog.LevelDebug, "Interrupt coalesced", "bus", i.BusAddr)
+				return // Already waiting on this bus, collapse into that one
+			}
+		}
+	}
+	p.pending = append(p.pending, i)
+	p.dispatch()
+}
+
+// intContext is what interrupt entry saves for IRET to put back. It's kept
+// in the processor, not on the stack, so a handler can't disturb the data
+// the interrupted code had pushed, nor find its own return address there.
+type intContext struct {
+	ip    uint16 // IP to resume at
+	flags uint16 // Flags as they were
+	bus   uint8  // Bus that raised the interrupt, for INTSOURCE
+}
+
+// dispatch enters the handler for the oldest pending interrupt
+func (p *Processor) dispatch() {
+	if p.servicing || p.prefixed || len(p.pending) == 0 {
+		return
+	}
+	i := p.pending[0]
+	p.pending = p.pending[1:]
+	p.servicing = true
+	p.stats.Interrupts++
+	p.saved = intContext{p.Register[IP].Get16(), p.Flags, i.BusAddr}
+	p.Register[IP].Put16(i.Handler)
+	p.log(slog.LevelDebug, "Interrupt dispatched", "bus", i.BusAddr, "handler", i.Handler, "ip", p.saved.ip)
+	p.call(EnterInterrupt, p.saved.ip, i.Handler, i.BusAddr)
+}
+
+// log records an event if there's a Logger
+func (p *Processor) log(level slog.Level, msg string, args ...any) {
+	if p.Logger != nil {
+		p.Logger.Log(context.Background(), level, msg, args...)
+	}
+}
+
 func (p *Processor) execute() (err error) {
-	var data uint16
 	var width uint16
-	inst, err := p.Memory.Load16(p.Register[IP].Get16(), 0)
+	start := p.Register[IP].Get16()
+	if p.halted {
+		return ProcError{"Processor is halted", FaultStall, start, 0, nil, nil}
+	}
+	if p.prefixed {
+		p.prefixed = false
+		defer p.dispatch() // Anything PRED held off
+	}
+	if p.CheckBoundaries && !p.onBoundary(start) {
+		p.log(slog.LevelError, "Mid-instruction jump", "ip", start)
+		return ProcError{"IP is in the middle of an instruction", FaultInstruction, start, 0, nil, nil}
+	}
+	var inst uint16
+	var d *decoded
+	if p.BlockCache {
+		inst, d, err = p.cachedFetch(start)
+	} else {
+		inst, err = p.fetch(start)
+	}
 	if err != nil {
-		return
+		p.log(slog.LevelError, "Fetch failed", "ip", start, "error", err)
+		return fault(FaultMemory, start, err)
+	}
+	opcode := uint8(inst >> 12)
+	defer func() {
+		if err != nil {
+			p.log(slog.LevelError, "Execution failed", "ip", start, "opcode", opcode, "error", err)
+		}
+	}()
+	arg1 := uint8(inst & 0xF00 >> 8)
+	arg2 := uint8(inst & 0xF0 >> 4)
+	arg3 := uint8(inst & 0xF)
+	if p.BeforeExec != nil {
+		p.BeforeExec(start, opcode, [3]uint8{arg1, arg2, arg3})
+	}
+	if d == nil || !d.checked || d.limit != limitKey(p.RegisterLimit) {
+		if err = p.checkArgs(opcode, arg1, arg2, arg3); err != nil {
+			return
+		}
+		if d != nil && opcode != WBUS && opcode != SBUS && opcode != RBUS {
+			d.checked, d.limit = true, limitKey(p.RegisterLimit) // Bus ops check a register's value
+		}
 	}
-	// fmt.Printf("0x%x  \n", inst)
+	p.stats.Instructions++
+	p.cycles++
+	if p.TrackCoverage {
+		if p.covered == nil {
+			p.covered = make([]bool, 0x10000)
+		}
+		p.covered[start] = true
+	}
+	p.stats.Opcodes[opcode]++
+	if opcode == NOT && arg3 != 0 {
+		p.stats.Extended[arg3]++
+	}
+	if d != nil {
+		p.imm, p.hasImm = d.imm, true // Operands the block cache already has
+		width, err = p.exec(opcode, arg1, arg2, arg3, d.base)
+		p.hasImm = false
+	} else {
+		width, err = p.exec(opcode, arg1, arg2, arg3, instrWidth(opcode, arg3))
+	}
+	// Since each case performs one op, we can catch all errors here.
+	ip := p.Register[IP].Get16()
+	overflow := p.TrapIPOverflow && uint32(ip)+uint32(width) > 0xFFFF
+	if !overflow {
+		p.Register[IP].Put16(ip + width) // Step two instructions
+	}
+	if p.AfterExec != nil {
+		p.AfterExec(start, opcode, [3]uint8{arg1, arg2, arg3})
+	}
+	if err != nil {
+		return fmt.Errorf("%w | %x %x", fault(faultCode(opcode), start, err), opcode, p.Register[IP].Get16())
+	}
+	if overflow {
+		return ProcError{"IP overflowed the address space", FaultMemory, ip, width, nil, nil}
+	}
+	if p.StallLimit > 0 {
+		if p.Register[IP].Get16() != start {
+			p.stalls = 0
+		} else if p.stalls++; p.stalls >= p.StallLimit {
+			p.stalls = 0
+			return ProcError{"Stalled, IP is not advancing", FaultStall, start, 0, []uint8{uint8(inst >> 8), uint8(inst)}, nil}
+		}
+	}
+	return
+}
+
+// fetch reads the instruction word at addr. Single byte instructions come
+// back in the high byte, so nothing past them is read.
+func (p *Processor) fetch(addr uint16) (uint16, error) {
+	first, err := p.mem().Load8(addr, 0)
+	if err != nil || opWidths[first>>4] == 1 {
+		return uint16(first) << 8, err
+	}
+	second, err := p.mem().Load8(addr, 1)
+	return uint16(first)<<8 | uint16(second), err
+}
+
+// ExecuteInstruction runs a single instruction word against the current
+// registers and memory without fetching it. immediate stands in for the
+// bytes that would follow the word in memory: all of it for set, high byte
+// first for extended and escaped instructions. The IP is not advanced; width is
+// how far execute would have moved it, or 0 if the instruction set the IP
+// itself. Hooks and the stall check don't run.
+func (p *Processor) ExecuteInstruction(inst uint16, immediate uint16) (width uint16, err error) {
 	opcode := uint8(inst >> 12)
 	arg1 := uint8(inst & 0xF00 >> 8)
 	arg2 := uint8(inst & 0xF0 >> 4)
 	arg3 := uint8(inst & 0xF)
-	width = 2 // Default to 2 since most instructions will be that size.
-	//fmt.Printf("\n\n\n\nopcode %x | args %x %x %x", opcode, arg1, arg2, arg3)
+	if err = p.checkArgs(opcode, arg1, arg2, arg3); err != nil {
+		return 0, err
+	}
+	p.imm, p.hasImm = immediate, true
+	defer func() { p.hasImm = false }()
+	if width, err = p.exec(opcode, arg1, arg2, arg3, instrWidth(opcode, arg3)); err != nil {
+		err = fault(faultCode(opcode), p.Register[IP].Get16(), err)
+	}
+	return
+}
+
+// faultCode picks the fault reported for a failed opcode
+func faultCode(opcode uint8) int {
+	if opcode == SBUS || opcode == RBUS {
+		return FaultBus
+	}
+	return FaultMemory
+}
+
+// immediate returns the word following the instruction
+func (p *Processor) immediate() (uint16, error) {
+	if p.hasImm {
+		return p.imm, nil
+	}
+	return loadImm(p.mem(), p.Register[IP].Get16(), SET, opWidths[SET])
+}
+
+// trailing returns the byte after a 2 byte instruction word
+func (p *Processor) trailing() (uint8, error) {
+	return p.operand(2)
+}
+
+// operand returns the byte n bytes into the current instruction, for the
+// operands of extended and escaped instructions. Under ExecuteInstruction
+// only bytes 2 and 3 exist, taken from the immediate high byte first.
+func (p *Processor) operand(n uint16) (uint8, error) {
+	if p.hasImm {
+		switch n {
+		case 2:
+			return uint8(p.imm >> 8), nil
+		case 3:
+			return uint8(p.imm), nil
+		}
+		return 0, ProcError{"Operand past the immediate", FaultInstruction, p.Register[IP].Get16(), n, nil, nil}
+	}
+	return p.mem().Load8(p.Register[IP].Get16(), n)
+}
+
+// exec performs one decoded instruction, returning how far to move the IP.
+// base is the instruction's width from instrWidth.
+func (p *Processor) exec(opcode, arg1, arg2, arg3 uint8, base uint16) (width uint16, err error) {
+	var data uint16
+	width = base
 	switch opcode {
 	case LOAD:
 		if arg3 > 0 {
-			p.Register[arg1].Low, err = p.Memory.Load8(p.Register[arg2].Get16(), 0)
+			p.Register[arg1].Low, err = p.mem().Load8(p.Register[arg2].Get16(), 0)
 		} else {
-			data, err = p.Memory.Load16(p.Register[arg2].Get16(), 0)
+			data, err = p.mem().Load16(p.Register[arg2].Get16(), 0)
 			p.Register[arg1].Put16(data)
 		}
 	case STORE:
+		addr, size := p.Register[arg2].Get16(), uint16(2)
 		if arg3 > 0 {
-			err = p.Memory.Save8(p.Register[arg2].Get16(), 0, p.Register[arg1].Low)
+			size = 1
+		}
+		if p.GuardCode && p.inCode(addr, size) {
+			err = ProcError{"Store into program code", FaultMemory, addr, 0, nil, nil}
+			break
+		}
+		if arg3 > 0 {
+			err = p.mem().Save8(addr, 0, p.Register[arg1].Low)
 		} else {
-			err = p.Memory.Save16(p.Register[arg2].Get16(), 0, p.Register[arg1].Get16())
+			err = p.mem().Save16(addr, 0, p.Register[arg1].Get16())
 		}
+		p.invalidate(addr, size)
 	case SET:
-		data, err = p.Memory.Load16(p.Register[IP].Get16(), 1)
+		data, err = p.immediate()
 		p.Register[arg1].Put16(data)
-		width = 3
 	case WBUS:
-		var e error
-		p.Register[p.Register[arg1].Low].Low, e = p.Bus.Which()
-		if e != nil {
-			// Error returned when no data waiting
-			// Set low to 0 and high to 1 ("overflow")
-			p.Register[p.Register[arg1].Low].Low = uint8(0x0)
-			p.Register[p.Register[arg1].Low].High = uint8(0x01)
-		}
-		width = 1
+		// Which errs when no bus has data. That's reported in FlagE, leaving
+		// the whole register range free for real bus addresses.
+		if addr, e := p.Bus.Which(); e != nil {
+			p.Flags |= FlagE
+		} else {
+			p.Register[p.Register[arg1].Low].Put16(uint16(addr))
+			p.Flags &^= FlagE
+		}
 	case SBUS:
-		err = p.Bus.Send(p.Register[arg1].High, p.Register[p.Register[arg1].Low].Get16())
-		width = 1
+		bus, data := p.Register[arg1].High, p.Register[p.Register[arg1].Low].Get16()
+		if bus == BROADCAST {
+			err = p.broadcast(data)
+		} else {
+			stop := p.watchBus(SBUS, bus)
+			err = p.Bus.Send(bus, data)
+			stop()
+		}
+		if err == nil {
+			p.stats.BusSends++
+			if p.OnSend != nil {
+				p.OnSend(bus, data)
+			}
+		}
 	case RBUS:
+		switch p.Register[arg1].High {
+		case CYCLES:
+			p.Register[p.Register[arg1].Low].Put16(uint16(p.cycles))
+			return
+		case INTSOURCE:
+			if !p.servicing {
+				return width, p.noInterrupt()
+			}
+			p.Register[p.Register[arg1].Low].Put16(uint16(p.saved.bus))
+			return
+		}
+		stop := p.watchBus(RBUS, p.Register[arg1].High)
 		data, err = p.Bus.Recv(p.Register[arg1].High)
+		stop()
 		p.Register[p.Register[arg1].Low].Put16(data)
-		width = 1
+		if err == nil {
+			p.stats.BusRecvs++
+		}
 	case LJUMP:
 		if p.Register[arg1].Get16() < p.Register[arg2].Get16() {
 			p.Register[IP] = p.Register[arg3]
@@ -224,35 +1371,444 @@ func (p *Processor) execute() (err error) {
 			p.Register[IP] = p.Register[arg3]
 			width = 0
 		}
-	case ADD:
-		data = p.Register[arg2].Get16() + p.Register[arg3].Get16()
-		p.Register[arg1].Put16(data)
-	case SUB:
-		data = p.Register[arg2].Get16() - p.Register[arg3].Get16()
-		p.Register[arg1].Put16(data)
-	case SHL:
-		data = p.Register[arg2].Get16() << p.Register[arg3].Get16()
-		p.Register[arg1].Put16(data)
-	case SHR:
-		data = p.Register[arg2].Get16() >> p.Register[arg3].Get16()
-		p.Register[arg1].Put16(data)
-	case AND:
-		data = p.Register[arg2].Get16() & p.Register[arg3].Get16()
-		p.Register[arg1].Put16(data)
-	case OR:
-		data = p.Register[arg2].Get16() | p.Register[arg3].Get16()
-		p.Register[arg1].Put16(data)
-	case NOT:
-		data = p.Register[arg2].Get16() ^ uint16(0xFFFF)
+	case ADD, SUB, SHL, SHR, AND, OR, NOT, XOR:
+		if opcode == NOT && arg3 != 0 {
+			width, err = p.extended(arg3, arg1, arg2)
+			break
+		}
+		a, b := p.Register[arg2].Get16(), p.Register[arg3].Get16()
+		switch {
+		case !p.Strict:
+		case opcode == SUB && a < b:
+			return width, ProcError{"Unsigned subtract underflow", FaultStrict, p.Register[IP].Get16(), 0, nil, nil}
+		case (opcode == SHL || opcode == SHR) && b >= 16:
+			return width, ProcError{"Shift by 16 or more", FaultStrict, p.Register[IP].Get16(), 0, nil, nil}
+		}
+		var flags uint16
+		data, flags, _ = Arith(opcode, a, b, p.Saturate)
 		p.Register[arg1].Put16(data)
-	case XOR:
-		data = p.Register[arg2].Get16() ^ p.Register[arg3].Get16()
+		p.Flags = p.Flags&^aluFlags | flags
+	}
+	return
+}
+
+// regArgs marks which argument nibbles of each opcode name registers
+var regArgs = [16][3]bool{
+	LOAD:  {true, true, false},
+	STORE: {true, true, false},
+	SET:   {true, false, false},
+	WBUS:  {true, false, false},
+	SBUS:  {true, false, false},
+	RBUS:  {true, false, false},
+	LJUMP: {true, true, true},
+	EJUMP: {true, true, true},
+	ADD:   {true, true, true},
+	SUB:   {true, true, true},
+	SHL:   {true, true, true},
+	SHR:   {true, true, true},
+	AND:   {true, true, true},
+	OR:    {true, true, true},
+	NOT:   {true, true, false},
+	XOR:   {true, true, true},
+}
+
+// usable reports whether a program may touch register r
+func (p *Processor) usable(r uint8) bool {
+	if r >= uint8(len(p.Register)) {
+		return false
+	}
+	return p.RegisterLimit == 0 || int(r) < p.RegisterLimit || r == IP
+}
+
+// checkRegs traps on the first register a program may not touch
+func (p *Processor) checkRegs(regs ...uint8) error {
+	for _, r := range regs {
+		if !p.usable(r) {
+			return ProcError{"Register out of range", FaultRegister, p.Register[IP].Get16(), 0, []uint8{r}, nil}
+		}
+	}
+	return nil
+}
+
+// checkArgs traps on any register argument of the instruction that a
+// program may not touch. Extended instructions check their own.
+func (p *Processor) checkArgs(opcode, arg1, arg2, arg3 uint8) error {
+	if opcode == NOT && arg3 != 0 {
+		return nil
+	}
+	for i, r := range [3]uint8{arg1, arg2, arg3} {
+		if regArgs[opcode][i] {
+			if err := p.checkRegs(r); err != nil {
+				return err
+			}
+		}
+	}
+	switch opcode {
+	case WBUS, SBUS, RBUS:
+		return p.checkRegs(p.Register[arg1].Low) // Data register is indirect
+	}
+	return nil
+}
+
+// setFlags updates the flags from an ALU result
+func (p *Processor) setFlags(result uint16, carry, overflow bool) {
+	p.Flags = p.Flags&^aluFlags | flagsFor(result, carry, overflow)
+}
+
+// inCode reports whether any of the size bytes at addr were written by Boot
+func (p *Processor) inCode(addr, size uint16) bool {
+	return uint32(addr)+uint32(size) > uint32(p.codeStart) && addr < p.codeEnd
+}
+
+// extended runs the instructions selected by NOT's third nibble
+func (p *Processor) extended(op, arg1, arg2 uint8) (width uint16, err error) {
+	width = instrWidth(NOT, op)
+	switch op {
+	case IRET:
+		if !p.servicing {
+			return width, ProcError{"IRET outside of interrupt handler", FaultInterrupt, p.Register[IP].Get16(), 0, nil, nil}
+		}
+		p.call(ExitInterrupt, p.Register[IP].Get16(), p.saved.ip, 0)
+		p.Register[IP].Put16(p.saved.ip)
+		p.Flags = p.saved.flags
+		p.servicing = false
+		p.dispatch() // Go straight to the next handler if one is waiting
+		width = 0
+	case SMUL:
+		var srcs uint8
+		srcs, err = p.trailing()
+		if err != nil {
+			return
+		}
+		if err = p.checkRegs(arg1, arg2, srcs>>4, srcs&0xF); err != nil {
+			return
+		}
+		a := int32(int16(p.Register[srcs>>4].Get16()))
+		b := int32(int16(p.Register[srcs&0xF].Get16()))
+		product := uint32(a * b)
+		p.Register[arg1].Put16(uint16(product >> 16))
+		p.Register[arg2].Put16(uint16(product)) // Low half wins if hi == lo
+	case SETB:
+		var value uint8
+		value, err = p.trailing()
+		if err != nil {
+			return
+		}
+		if err = p.checkRegs(arg1); err != nil {
+			return
+		}
+		p.Register[arg1].Put16(uint16(value))
+	case MEMSET, MEMCPY:
+		var third uint8
+		third, err = p.trailing()
+		if err != nil {
+			return
+		}
+		third >>= 4
+		if err = p.checkRegs(arg1, arg2, third); err != nil {
+			return
+		}
+		if op == MEMSET {
+			err = p.memset(p.Register[arg1].Get16(), p.Register[arg2].Get16(), p.Register[third].Low)
+		} else {
+			err = p.memcpy(p.Register[arg1].Get16(), p.Register[arg2].Get16(), p.Register[third].Get16())
+		}
+	case GETF:
+		if err = p.checkRegs(arg1); err != nil {
+			return
+		}
+		p.Register[arg1].Put16(p.Flags)
+	case SETF:
+		if err = p.checkRegs(arg1); err != nil {
+			return
+		}
+		p.Flags = p.Register[arg1].Get16()
+	case PUSH, POP, CALL, RET:
+		if err = p.checkRegs(arg1, SP); err != nil {
+			return
+		}
+		switch op {
+		case PUSH:
+			err = p.push(p.Register[arg1].Get16())
+		case POP:
+			var data uint16
+			data, err = p.pop()
+			p.Register[arg1].Put16(data)
+		case CALL:
+			if err = p.push(p.Register[IP].Get16() + width); err == nil {
+				p.call(EnterCall, p.Register[IP].Get16(), p.Register[arg1].Get16(), 0)
+				p.Register[IP] = p.Register[arg1]
+				width = 0
+			}
+		case RET:
+			var ret uint16
+			if ret, err = p.pop(); err == nil {
+				p.call(ExitCall, p.Register[IP].Get16(), ret, 0)
+				p.Register[IP].Put16(ret)
+				width = 0
+			}
+		}
+	case RLOAD, RSTORE:
+		if err = p.checkRegs(arg1, arg2); err != nil {
+			return
+		}
+		idx := p.Register[arg2].Get16()
+		if idx >= uint16(len(p.Register)) {
+			return width, ProcError{"Register index out of range", FaultRegister, p.Register[IP].Get16(), 0, []uint8{uint8(idx >> 8), uint8(idx)}, nil}
+		}
+		if err = p.checkRegs(uint8(idx)); err != nil {
+			return
+		}
+		if op == RLOAD {
+			p.Register[arg1] = p.Register[idx]
+		} else {
+			p.Register[idx] = p.Register[arg1]
+		}
+	case PEEK:
+		if err = p.checkRegs(arg1, arg2, p.Register[arg1].Low); err != nil {
+			return
+		}
+		pb, ok := p.Bus.(PeekBus)
+		if !ok {
+			return width, ProcError{"Bus can't peek", FaultBus, p.Register[IP].Get16(), 0, nil, nil}
+		}
+		data, present := pb.Peek(p.Register[arg1].High)
+		p.Register[p.Register[arg1].Low].Put16(data)
+		if present {
+			p.Register[arg2].Put16(1)
+		} else {
+			p.Register[arg2].Put16(0)
+		}
+	case ESC:
+		var sel uint8
+		if sel, err = p.trailing(); err != nil {
+			return
+		}
+		p.stats.Escaped[sel&0xF]++
+		width, err = p.escaped(sel&0xF, arg1, arg2, sel>>4)
+	default:
+		err = ProcError{"Unknown extended instruction", FaultInstruction, p.Register[IP].Get16(), 0, []uint8{op}, nil}
+	}
+	return
+}
+
+// escaped runs the second bank instructions selected by ESC's trailing byte
+func (p *Processor) escaped(op, arg1, arg2, arg3 uint8) (width uint16, err error) {
+	width = escWidth(op)
+	if op != PRED {
+		if err = p.checkRegs(arg1, arg2, arg3); err != nil {
+			return
+		}
+	}
+	var data uint16
+	switch op {
+	case NAND:
+		data = ^(p.Register[arg2].Get16() & p.Register[arg3].Get16())
+	case NOR:
+		data = ^(p.Register[arg2].Get16() | p.Register[arg3].Get16())
+	case PRED:
+		mask, want := uint16(arg1), uint16(arg2)
+		if p.Flags&mask == want&mask {
+			p.prefixed = true // Keep interrupts out until the next one runs
+			return
+		}
+		var next InstrInfo
+		if next, err = Decode(p.mem(), p.Register[IP].Get16()+width); err != nil {
+			return
+		}
+		return width + next.Width, nil
+	case POPCNT:
+		data = uint16(bits.OnesCount16(p.Register[arg2].Get16()))
+	case HALT:
+		p.halted = true
+		p.log(slog.LevelInfo, "HALT", "ip", p.Register[IP].Get16())
+		return
+	case NEG:
+		// Flags as for 0 - src, but Saturate doesn't apply: this is signed
+		src := p.Register[arg2].Get16()
+		data = -src
 		p.Register[arg1].Put16(data)
+		p.setFlags(data, src != 0, src == 0x8000)
+		return
+	case SBUSB, RBUSB:
+		if err = p.checkRegs(p.Register[arg1].Low); err != nil {
+			return
+		}
+		return width, p.busByte(op, p.Register[arg1].High, &p.Register[p.Register[arg1].Low])
+	case MUL:
+		var b uint8
+		if b, err = p.operand(3); err != nil {
+			return
+		}
+		if err = p.checkRegs(b >> 4); err != nil {
+			return
+		}
+		product := uint32(p.Register[arg3].Get16()) * uint32(p.Register[b>>4].Get16())
+		p.Register[arg1].Put16(uint16(product >> 16))
+		p.Register[arg2].Put16(uint16(product)) // Low half wins if hi == lo
+		return
+	default:
+		return width, ProcError{"Unknown escaped instruction", FaultInstruction, p.Register[IP].Get16(), 0, []uint8{op}, nil}
 	}
-	// Since each case performs one op, we can catch all errors here.
-	p.Register[IP].Put16(p.Register[IP].Get16() + width) // Step two instructions
+	p.Register[arg1].Put16(data)
+	p.setFlags(data, false, false)
+	return
+}
+
+// busByte carries out SBUSB or RBUSB, moving the low byte of reg. Bus
+// errors are reported as bus faults, as for SBUS and RBUS.
+func (p *Processor) busByte(op, bus uint8, reg *Register) error {
+	bb, wide := p.Bus.(ByteBus)
+	var err error
+	if op == SBUSB {
+		data := reg.Low
+		switch {
+		case bus == BROADCAST:
+			err = p.broadcast(uint16(data))
+		case wide:
+			stop := p.watchBus(SBUS, bus)
+			err = bb.Send8(bus, data)
+			stop()
+		default:
+			stop := p.watchBus(SBUS, bus)
+			err = p.Bus.Send(bus, uint16(data))
+			stop()
+		}
+		if err != nil {
+			return fault(FaultBus, p.Register[IP].Get16(), err)
+		}
+		p.stats.BusSends++
+		if p.OnSend != nil {
+			p.OnSend(bus, uint16(data))
+		}
+		return nil
+	}
+	var data uint8
+	switch {
+	case bus == CYCLES:
+		data = uint8(p.cycles)
+	case bus == INTSOURCE:
+		if !p.servicing {
+			return p.noInterrupt()
+		}
+		data = p.saved.bus
+	case wide:
+		stop := p.watchBus(RBUS, bus)
+		data, err = bb.Recv8(bus)
+		stop()
+	default:
+		stop := p.watchBus(RBUS, bus)
+		var word uint16
+		word, err = p.Bus.Recv(bus)
+		stop()
+		data = uint8(word)
+	}
+	reg.Put16(uint16(data))
 	if err != nil {
-		return fmt.Errorf("%s | %x %x", err.Error(), opcode, p.Register[IP].Get16())
+		return fault(FaultBus, p.Register[IP].Get16(), err)
 	}
-	return
+	if bus != CYCLES && bus != INTSOURCE {
+		p.stats.BusRecvs++
+	}
+	return nil
+}
+
+// broadcast sends data to BROADCAST, if the bus can take it
+func (p *Processor) broadcast(data uint16) error {
+	bb, ok := p.Bus.(BroadcastBus)
+	if !ok {
+		return ProcError{"Bus can't broadcast", FaultBus, p.Register[IP].Get16(), 0, nil, nil}
+	}
+	return bb.Broadcast(data)
+}
+
+// noInterrupt is the error for reading INTSOURCE outside a handler
+func (p *Processor) noInterrupt() error {
+	return ProcError{"No interrupt is being serviced", FaultInterrupt, p.Register[IP].Get16(), 0, nil, nil}
+}
+
+// checkRange makes sure length bytes from start don't run off the end of
+// the address space, and, with GuardCode, don't land on the program
+func (p *Processor) checkRange(start, length uint16, write bool) error {
+	if uint32(start)+uint32(length) > 0x10000 {
+		return ProcError{"Range runs past end of memory", FaultMemory, start, length, nil, nil}
+	}
+	if write && p.GuardCode && length > 0 && p.inCode(start, length) {
+		return ProcError{"Store into program code", FaultMemory, start, length, nil, nil}
+	}
+	return nil
+}
+
+func (p *Processor) memset(start, length uint16, value uint8) error {
+	if err := p.checkRange(start, length, true); err != nil {
+		return err
+	}
+	defer p.invalidate(start, length)
+	for i := uint16(0); i < length; i++ {
+		if err := p.mem().Save8(start, i, value); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// memcpy behaves like memmove, overlapping ranges copy as if via a buffer
+func (p *Processor) memcpy(dst, src, length uint16) error {
+	if err := p.checkRange(src, length, false); err != nil {
+		return err
+	}
+	if err := p.checkRange(dst, length, true); err != nil {
+		return err
+	}
+	defer p.invalidate(dst, length)
+	copyByte := func(i uint16) error {
+		b, err := p.mem().Load8(src, i)
+		if err != nil {
+			return err
+		}
+		return p.mem().Save8(dst, i, b)
+	}
+	if dst > src {
+		for i := length; i > 0; i-- { // Back to front so src isn't clobbered first
+			if err := copyByte(i - 1); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	for i := uint16(0); i < length; i++ {
+		if err := copyByte(i); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// push stores a word below SP, trapping if that runs into the heap
+func (p *Processor) push(data uint16) error {
+	top := uint32(p.Register[SP].Get16())
+	if top == 0 {
+		top = 0x10000 // The default SP on flat memory, see initSP
+	}
+	sp := uint16(top - 2)
+	if p.StackLimit != 0 && top < uint32(p.StackLimit)+2 {
+		return ProcError{"Stack overflow into heap", FaultStack, sp, p.StackLimit, nil, nil}
+	}
+	if err := p.mem().Save16(sp, 0, data); err != nil {
+		return err
+	}
+	p.invalidate(sp, 2)
+	p.Register[SP].Put16(sp)
+	return nil
+}
+
+// pop loads the word at SP and moves SP up past it
+func (p *Processor) pop() (uint16, error) {
+	sp := p.Register[SP].Get16()
+	data, err := p.mem().Load16(sp, 0)
+	if err != nil {
+		return 0, err
+	}
+	p.Register[SP].Put16(sp + 2)
+	return data, nil
 }
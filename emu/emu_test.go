@@ -0,0 +1,1517 @@
+package emu
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"log/slog"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+)
+
+// testBus is a Bus with no devices behind it. Sends are kept in sent and
+// receives get 0.
+type testBus struct {
+	sent []uint16
+}
+
+func (b *testBus) Send(addr uint8, data uint16) error {
+	b.sent = append(b.sent, data)
+	return nil
+}
+
+func (b *testBus) Recv(addr uint8) (uint16, error) { return 0, nil }
+func (b *testBus) Which() (uint8, error)           { return 0, errors.New("No bus has data") }
+func (b *testBus) Interrupts(chan<- Interrupt)     {}
+func (b *testBus) Broadcast(data uint16) error     { return b.Send(BROADCAST, data) }
+
+// bankedRAM is BankedMemory made of equal sized RAMs
+type bankedRAM struct {
+	banks []*RAM
+	size  uint16
+	cur   int
+}
+
+func newBankedRAM(banks int, size uint16) *bankedRAM {
+	m := &bankedRAM{size: size}
+	for range banks {
+		m.banks = append(m.banks, NewRAM(uint32(size)))
+	}
+	return m
+}
+
+func (m *bankedRAM) Load8(addr, offset uint16) (uint8, error) {
+	return m.banks[m.cur].Load8(addr, offset)
+}
+
+func (m *bankedRAM) Load16(addr, offset uint16) (uint16, error) {
+	return m.banks[m.cur].Load16(addr, offset)
+}
+
+func (m *bankedRAM) Save8(addr, offset uint16, data uint8) error {
+	return m.banks[m.cur].Save8(addr, offset, data)
+}
+
+func (m *bankedRAM) Save16(addr, offset, data uint16) error {
+	return m.banks[m.cur].Save16(addr, offset, data)
+}
+
+func (m *bankedRAM) Banks() int { return len(m.banks) }
+
+func (m *bankedRAM) BankSize() uint16 { return m.size }
+
+func (m *bankedRAM) Bank() int { return m.cur }
+
+func (m *bankedRAM) SelectBank(bank int) error {
+	if bank < 0 || bank >= len(m.banks) {
+		return fmt.Errorf("No bank %d", bank)
+	}
+	m.cur = bank
+	return nil
+}
+
+// newTestProcessor boots src, assembled at 0, into 64K of RAM
+func newTestProcessor(t testing.TB, src string) *Processor {
+	t.Helper()
+	code, err := Assemble(src)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p := NewProcessor(NewRAM(0x10000), NewBootmedia(code, 0, 0), &testBus{}, nil)
+	if err := p.Boot(); err != nil {
+		t.Fatal(err)
+	}
+	return &p
+}
+
+// codeOf is the fault code of err, or -1 if it isn't a ProcError
+func codeOf(err error) int {
+	var pe ProcError
+	if !errors.As(err, &pe) {
+		return -1
+	}
+	return pe.Code()
+}
+
+// steps executes n instructions, failing on the first fault
+func steps(t testing.TB, p *Processor, n int) {
+	t.Helper()
+	for i := 0; i < n; i++ {
+		if err := p.execute(); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+// spin loops at 0 forever, with a handler at 5 that counts in r7
+const spin = `
+loop:
+	set r2, loop
+	jmp r2
+handler:
+	add r7, r7, r3
+	iret
+`
+
+func TestCoalesce(t *testing.T) {
+	for _, tc := range []struct {
+		coalesce bool
+		want     uint16
+	}{
+		{false, 10},
+		{true, 2}, // The one being handled, then the rest as one
+	} {
+		p := newTestProcessor(t, spin)
+		p.Coalesce = tc.coalesce
+		p.Register[3].Put16(1)
+		for range 10 {
+			if err := p.Interrupt(Interrupt{BusAddr: 1, Handler: 5}); err != nil {
+				t.Fatal(err)
+			}
+		}
+		steps(t, p, 60)
+		if got := p.Register[7].Get16(); got != tc.want {
+			t.Errorf("coalesce %v: handler ran %d times, want %d", tc.coalesce, got, tc.want)
+		}
+	}
+}
+
+func TestSaveRestoreRegisters(t *testing.T) {
+	p := newTestProcessor(t, "nop")
+	for i := range p.Register {
+		p.Register[i].Put16(uint16(0x1111 * i))
+	}
+	saved := p.SaveRegisters()
+	for i := range p.Register {
+		p.Register[i].Put16(0xdead)
+	}
+	p.RestoreRegisters(saved)
+	for i := range p.Register {
+		if got := p.Register[i].Get16(); got != uint16(0x1111*i) {
+			t.Errorf("r%d restored as %x, want %x", i, got, uint16(0x1111*i))
+		}
+	}
+	if p.SaveRegisters() != saved {
+		t.Error("saving again gave different registers")
+	}
+}
+
+func TestStallLimit(t *testing.T) {
+	p := newTestProcessor(t, `
+		set r2, self
+	self:
+		jmp r2
+	`)
+	p.StallLimit = 3
+	steps(t, p, 3) // The set, then two jumps that don't move
+	err := p.execute()
+	if codeOf(err) != FaultStall {
+		t.Fatalf("got %v, want a stall", err)
+	}
+	if ip := p.Register[IP].Get16(); ip != 3 {
+		t.Errorf("stalled at %x, want 3", ip)
+	}
+}
+
+func TestSmul(t *testing.T) {
+	for _, tc := range []struct {
+		a, b    uint16
+		hi, low uint16
+	}{
+		{0xfffe, 0xfffd, 0x0000, 0x0006}, // -2 * -3
+		{0xfffd, 0x0005, 0xffff, 0xfff1}, // -3 * 5
+		{0x0005, 0xfffd, 0xffff, 0xfff1},
+		{0x8000, 0x8000, 0x4000, 0x0000}, // -32768 squared
+		{0x8000, 0x7fff, 0xc000, 0x8000},
+		{0xfffe, 0x8000, 0x0001, 0x0000},
+	} {
+		p := newTestProcessor(t, "smul r1, r2, r3, r4")
+		p.Register[3].Put16(tc.a)
+		p.Register[4].Put16(tc.b)
+		steps(t, p, 1)
+		if hi, low := p.Register[1].Get16(), p.Register[2].Get16(); hi != tc.hi || low != tc.low {
+			t.Errorf("%d * %d gave %04x %04x, want %04x %04x", int16(tc.a), int16(tc.b), hi, low, tc.hi, tc.low)
+		}
+	}
+}
+
+func TestGuardCode(t *testing.T) {
+	const src = `
+		set r1, 0x100
+		store r2, r1
+		setb r1, 1
+		store r2, r1
+	`
+	p := newTestProcessor(t, src)
+	p.GuardCode = true
+	p.Register[2].Put16(0xffff)
+	steps(t, p, 3) // A store past the code is fine
+	if err := p.execute(); codeOf(err) != FaultMemory {
+		t.Fatalf("store into code gave %v, want a memory fault", err)
+	}
+	if b, _ := p.Memory.Load8(1, 0); b != 0x01 {
+		t.Errorf("guarded code byte changed to %x", b)
+	}
+
+	p = newTestProcessor(t, src)
+	p.Register[2].Put16(0xffff)
+	steps(t, p, 4)
+	if b, _ := p.Memory.Load8(1, 0); b != 0xff {
+		t.Errorf("unguarded store left %x, want ff", b)
+	}
+}
+
+func TestSetb(t *testing.T) {
+	p := newTestProcessor(t, "setb r3, 13\nsetb r4, 0\nsetb r5, 0xff")
+	p.Register[4].Put16(0xffff) // The whole register is replaced
+	for i, want := range []struct{ reg, value, ip uint16 }{{3, 13, 3}, {4, 0, 6}, {5, 0xff, 9}} {
+		steps(t, p, 1)
+		if got := p.Register[want.reg].Get16(); got != want.value {
+			t.Errorf("setb %d: r%d is %x, want %x", i, want.reg, got, want.value)
+		}
+		if ip := p.Register[IP].Get16(); ip != want.ip {
+			t.Errorf("setb %d: IP %d, want %d", i, ip, want.ip)
+		}
+	}
+	if _, err := Assemble("setb r1, 0x100"); err == nil {
+		t.Error("setb of a constant over 8 bits assembled")
+	}
+}
+
+func TestRegisterLimit(t *testing.T) {
+	p := newTestProcessor(t, `
+		add r1, r2, r3
+		set ip, 2 ; A no-op, the IP is always usable
+		add r4, r1, r1
+	`)
+	p.RegisterLimit = 4
+	steps(t, p, 2)
+	err := p.execute()
+	if codeOf(err) != FaultRegister {
+		t.Fatalf("using r4 gave %v, want a register fault", err)
+	}
+	if ip := p.Register[IP].Get16(); ip != 5 {
+		t.Errorf("IP moved to %d on the trap", ip)
+	}
+	p.RegisterLimit = 0 // No limit
+	steps(t, p, 1)
+}
+
+func TestMemsetMemcpy(t *testing.T) {
+	// r1 start or dst, r2 length or src, r3 value or length
+	p := newTestProcessor(t, "memset r1, r2, r3\nmemcpy r1, r2, r3")
+	load := func(addr uint16, n int) []uint8 {
+		b := make([]uint8, n)
+		for i := range b {
+			b[i], _ = p.Memory.Load8(addr, uint16(i))
+		}
+		return b
+	}
+	p.Register[1].Put16(0x100)
+	p.Register[2].Put16(6)
+	p.Register[3].Put16(0x12ab) // Only the low byte is used
+	steps(t, p, 1)
+	if got := load(0x100, 7); !bytes.Equal(got, []uint8{0xab, 0xab, 0xab, 0xab, 0xab, 0xab, 0}) {
+		t.Errorf("memset left % x", got)
+	}
+
+	for _, tc := range []struct {
+		dst, src uint16
+		want     []uint8
+	}{
+		{0x102, 0x100, []uint8{0, 1, 0, 1, 2, 3}}, // Forward overlap
+		{0x100, 0x102, []uint8{2, 3, 4, 5, 4, 5}}, // Backward overlap
+		{0x100, 0x100, []uint8{0, 1, 2, 3, 4, 5}},
+	} {
+		for i := range uint16(6) {
+			p.Memory.Save8(0x100, i, uint8(i))
+		}
+		p.Register[1].Put16(tc.dst)
+		p.Register[2].Put16(tc.src)
+		p.Register[3].Put16(4)
+		p.Register[IP].Put16(3) // memset is 3 bytes
+		steps(t, p, 1)
+		if got := load(0x100, 6); !bytes.Equal(got, tc.want) {
+			t.Errorf("memcpy 4 bytes %x to %x left % x, want % x", tc.src, tc.dst, got, tc.want)
+		}
+	}
+
+	p.Register[1].Put16(0xfffe) // Past the end of memory
+	p.Register[IP].Put16(0)
+	if err := p.execute(); err == nil {
+		t.Error("memset ran off the end of memory")
+	}
+}
+
+// deadBus is a testBus whose devices have all gone away
+type deadBus struct{ testBus }
+
+func (b *deadBus) Send(addr uint8, data uint16) error { return errors.New("Device gone") }
+func (b *deadBus) Recv(addr uint8) (uint16, error)    { return 0, errors.New("Device gone") }
+
+func TestFaultCodes(t *testing.T) {
+	code, err := Assemble("set r1, 0x0102\nsbus r1\nrbus r1\nset r3, 0x2000\nload r4, r3")
+	if err != nil {
+		t.Fatal(err)
+	}
+	p := NewProcessor(NewRAM(0x1000), NewBootmedia(code, 0, 0), &deadBus{}, nil)
+	if err := p.Boot(); err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []int{-1, FaultBus, FaultBus, -1, FaultMemory} {
+		ip := p.Register[IP].Get16()
+		if err := p.execute(); codeOf(err) != want {
+			t.Errorf("instruction at %d: %v, want code %d", ip, err, want)
+		}
+	}
+}
+
+func TestWarmReset(t *testing.T) {
+	code, err := Assemble("set r1, 0x100\nset r2, 0xbeef\nstore r2, r1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	p := NewProcessor(NewRAM(0x1000), NewBootmedia(code, 0x10, 0x10), &testBus{}, nil)
+	if err := p.Boot(); err != nil {
+		t.Fatal(err)
+	}
+	booted := p.SaveRegisters()
+	steps(t, &p, 3)
+	p.Flags = FlagC
+	if err := p.WarmReset(); err != nil {
+		t.Fatal(err)
+	}
+	if got := p.SaveRegisters(); got != booted {
+		t.Errorf("registers after warm reset %x, want %x as booted", got, booted)
+	}
+	if ip := p.Register[IP].Get16(); ip != 0x10 {
+		t.Errorf("IP %x, want the start, 10", ip)
+	}
+	if p.Flags != 0 {
+		t.Errorf("flags %x kept", p.Flags)
+	}
+	if w, _ := p.Memory.Load16(0x100, 0); w != 0xbeef {
+		t.Errorf("stored word is %x after warm reset, want beef", w)
+	}
+}
+
+func TestResetVector(t *testing.T) {
+	code, syms, err := AssembleWithSymbols(`
+		setb r1, 1
+		halt
+	vector:
+		.word entry
+	entry:
+		setb r1, 2
+		halt
+	`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p := NewProcessor(NewRAM(0x100), NewBootmedia(code, 0, 0), &testBus{}, nil)
+	p.UseResetVector, p.ResetVector = true, syms["vector"]
+	if err := p.Boot(); err != nil {
+		t.Fatal(err)
+	}
+	if ip := p.Register[IP].Get16(); ip != syms["entry"] {
+		t.Fatalf("booted at %d, want the vector's %d", ip, syms["entry"])
+	}
+	for !p.Halted() {
+		steps(t, &p, 1)
+	}
+	if r1 := p.Register[1].Get16(); r1 != 2 {
+		t.Errorf("r1 %d, want 2 from the code at the vector", r1)
+	}
+
+	// Each of these falls back to the bootmedia's start
+	for _, tc := range []struct {
+		name          string
+		vector, entry uint16
+	}{
+		{"zero", syms["vector"], 0},
+		{"entry outside memory", syms["vector"], 0x2000},
+		{"vector outside memory", 0x1000, 0},
+	} {
+		p.ResetVector = tc.vector
+		if err := p.Memory.Save16(syms["vector"], 0, tc.entry); err != nil {
+			t.Fatal(err)
+		}
+		if err := p.WarmReset(); err != nil {
+			t.Fatalf("%s: %v", tc.name, err)
+		}
+		if ip := p.Register[IP].Get16(); ip != 0 {
+			t.Errorf("%s: reset to %d, want the start, 0", tc.name, ip)
+		}
+	}
+}
+
+func TestGetfSetf(t *testing.T) {
+	p := newTestProcessor(t, `
+		set r1, 0xffff
+		setb r2, 1
+		add r3, r1, r2 ; Zero and carry
+		getf r4
+		add r3, r2, r2 ; Clears them
+		setf r4
+	`)
+	steps(t, p, 4)
+	saved := p.Flags
+	if saved&(FlagZ|FlagC) != FlagZ|FlagC || p.Register[4].Get16() != saved {
+		t.Fatalf("getf saved %x with flags %x, want Z and C", p.Register[4].Get16(), saved)
+	}
+	steps(t, p, 1)
+	if p.Flags&(FlagZ|FlagC) != 0 {
+		t.Fatalf("flags %x after 1 + 1", p.Flags)
+	}
+	steps(t, p, 1)
+	if p.Flags != saved {
+		t.Errorf("setf restored %x, want %x", p.Flags, saved)
+	}
+}
+
+func TestSaturate(t *testing.T) {
+	for _, tc := range []struct {
+		saturate  bool
+		sum, diff uint16
+	}{
+		{false, 0x0000, 0xffff},
+		{true, 0xffff, 0x0000},
+	} {
+		p := newTestProcessor(t, "add r3, r1, r2\nsub r4, r0, r2")
+		p.Saturate = tc.saturate
+		p.Register[1].Put16(0xffff)
+		p.Register[2].Put16(1)
+		steps(t, p, 1)
+		if got := p.Register[3].Get16(); got != tc.sum || p.Flags&FlagC == 0 {
+			t.Errorf("saturate %v: 0xffff + 1 = %x flags %x, want %x with carry", tc.saturate, got, p.Flags, tc.sum)
+		}
+		steps(t, p, 1)
+		if got := p.Register[4].Get16(); got != tc.diff || p.Flags&FlagC == 0 {
+			t.Errorf("saturate %v: 0 - 1 = %x flags %x, want %x with borrow", tc.saturate, got, p.Flags, tc.diff)
+		}
+	}
+}
+
+func TestStackLimit(t *testing.T) {
+	p := newTestProcessor(t, `
+		set sp, 0x104
+		push r1
+		push r1
+		push r1
+	`)
+	p.StackLimit = 0x100
+	steps(t, p, 3) // Fills the stack down to the limit
+	if err := p.execute(); codeOf(err) != FaultStack {
+		t.Fatalf("push past the limit gave %v, want a stack fault", err)
+	}
+	if sp := p.Register[SP].Get16(); sp != 0x100 {
+		t.Errorf("SP %x after the trap, want 100", sp)
+	}
+
+	p = newTestProcessor(t, "set sp, 0x100\nset r1, 0\ncall r1") // Already full
+	p.StackLimit = 0x100
+	steps(t, p, 2)
+	if err := p.execute(); codeOf(err) != FaultStack {
+		t.Errorf("call past the limit gave %v, want a stack fault", err)
+	}
+}
+
+func TestExecHooks(t *testing.T) {
+	p := newTestProcessor(t, `
+		setb r1, 1
+		add r2, r2, r1
+		sub r3, r3, r1
+		add r2, r2, r1
+		add r2, r2, r1
+	`)
+	var before, after int
+	var ips []uint16
+	p.BeforeExec = func(ip uint16, opcode uint8, args [3]uint8) {
+		if opcode == ADD {
+			before++
+			ips = append(ips, ip)
+		}
+	}
+	p.AfterExec = func(ip uint16, opcode uint8, args [3]uint8) {
+		if opcode == ADD && args == [3]uint8{2, 2, 1} {
+			after++
+		}
+	}
+	steps(t, p, 5)
+	if before != 3 || after != 3 {
+		t.Errorf("hooks saw %d and %d adds, want 3", before, after)
+	}
+	if !slices.Equal(ips, []uint16{3, 7, 9}) {
+		t.Errorf("adds at %v, want [3 7 9]", ips)
+	}
+}
+
+func TestExecuteInstruction(t *testing.T) {
+	p := newTestProcessor(t, "nop")
+	p.Register[2].Put16(7)
+	p.Register[3].Put16(5)
+	for _, tc := range []struct {
+		name string
+		inst uint16
+		want uint16
+	}{
+		{"add", 0x8123, 12},
+		{"sub", 0x9123, 2},
+		{"shl", 0xa123, 7 << 5},
+		{"shr", 0xb123, 0},
+		{"and", 0xc123, 5},
+		{"or", 0xd123, 7},
+		{"not", 0xe120, ^uint16(7)},
+		{"xor", 0xf123, 2},
+	} {
+		width, err := p.ExecuteInstruction(tc.inst, 0)
+		if err != nil || width != 2 {
+			t.Errorf("%s: width %d err %v", tc.name, width, err)
+		}
+		if got := p.Register[1].Get16(); got != tc.want {
+			t.Errorf("%s 7, 5 gave %x, want %x", tc.name, got, tc.want)
+		}
+	}
+	if width, err := p.ExecuteInstruction(0x2400, 0xbeef); err != nil || width != 3 || p.Register[4].Get16() != 0xbeef {
+		t.Errorf("set with an immediate: width %d err %v r4 %x", width, err, p.Register[4].Get16())
+	}
+	if ip := p.Register[IP].Get16(); ip != 0 {
+		t.Errorf("IP moved to %d", ip)
+	}
+}
+
+func TestLogging(t *testing.T) {
+	code, err := Assemble("setb r1, 1\nhalt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var logged strings.Builder
+	p := NewProcessor(NewRAM(0x100), NewBootmedia(code, 0x10, 0x10), &testBus{}, nil)
+	p.Logger = slog.New(slog.NewTextHandler(&logged, &slog.HandlerOptions{
+		ReplaceAttr: func(groups []string, a slog.Attr) slog.Attr {
+			if a.Key == slog.TimeKey {
+				return slog.Attr{}
+			}
+			return a
+		},
+	}))
+	if err := p.Boot(); err != nil {
+		t.Fatal(err)
+	}
+	tick := make(chan time.Time)
+	close(tick) // Free running
+	p.Ticker = tick
+	p.Run(make(chan error))
+	want := []string{
+		"level=INFO msg=Booted ip=16 start=16 end=" + fmt.Sprint(0x10+len(code)),
+		"level=INFO msg=HALT ip=19",
+		"level=INFO msg=Halted ip=22", // Past the halt
+	}
+	if got := strings.Split(strings.TrimSpace(logged.String()), "\n"); !slices.Equal(got, want) {
+		t.Errorf("logged\n%s\nwant\n%s", strings.Join(got, "\n"), strings.Join(want, "\n"))
+	}
+}
+
+func TestCheckBoundaries(t *testing.T) {
+	for _, tc := range []struct {
+		target string
+		fault  bool
+	}{
+		{"6", true},  // The immediate of the set at 5
+		{"5", false}, // The set itself
+	} {
+		p := newTestProcessor(t, "set r1, "+tc.target+"\njmp r1\nset r2, 0x1234")
+		p.CheckBoundaries = true
+		steps(t, p, 2)
+		err := p.execute()
+		if tc.fault != (codeOf(err) == FaultInstruction) {
+			t.Errorf("jump to %s gave %v", tc.target, err)
+		}
+	}
+}
+
+func TestDefaultStack(t *testing.T) {
+	// SP starts at 0 on flat memory, standing for the top of the 64K
+	p := newTestProcessor(t, "push r1\npush r1")
+	p.StackLimit = 0x8000
+	steps(t, p, 1)
+	if sp := p.Register[SP].Get16(); sp != 0xfffe {
+		t.Errorf("first push left SP %x, want fffe", sp)
+	}
+	p = newTestProcessor(t, "push r1")
+	p.StackLimit = 0xffff
+	if err := p.execute(); codeOf(err) != FaultStack {
+		t.Errorf("push with no room gave %v, want a stack fault", err)
+	}
+
+	// A reset taken inside Run puts SP back at the top of the bank
+	code, err := Assemble(spin)
+	if err != nil {
+		t.Fatal(err)
+	}
+	q := NewProcessor(newBankedRAM(1, 0x1000), NewBootmedia(code, 0, 0), &testBus{}, nil)
+	if err := q.Boot(); err != nil {
+		t.Fatal(err)
+	}
+	q.Register[SP].Put16(0x20)
+	tick, ints := make(chan time.Time), make(chan Interrupt)
+	close(tick)
+	q.Ticker, q.Ints = tick, ints
+	done := make(chan struct{})
+	go func() {
+		q.Run(make(chan error))
+		close(done)
+	}()
+	ints <- Interrupt{Reset: true}
+	close(ints)
+	<-done
+	if sp := q.Register[SP].Get16(); sp != 0x1000 {
+		t.Errorf("SP %x after a reset in Run, want 1000", sp)
+	}
+}
+
+func TestRunUnreadError(t *testing.T) {
+	code, err := Assemble("set r2, 0x2000\nload r1, r2") // Past the end of memory
+	if err != nil {
+		t.Fatal(err)
+	}
+	p := NewProcessor(NewRAM(0x100), NewBootmedia(code, 0, 0), &testBus{}, nil)
+	if err := p.Boot(); err != nil {
+		t.Fatal(err)
+	}
+	tick, ints := make(chan time.Time), make(chan Interrupt)
+	close(tick)
+	p.Ticker, p.Ints = tick, ints
+	done := make(chan struct{})
+	go func() {
+		p.Run(make(chan error)) // Nobody reads it
+		close(done)
+	}()
+	ints <- Interrupt{BusAddr: 1} // Taken even with an error waiting
+	close(ints)
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("Run didn't return with its error unread")
+	}
+}
+
+func TestStrict(t *testing.T) {
+	for _, strict := range []bool{false, true} {
+		p := newTestProcessor(t, "nop")
+		p.Strict = strict
+		p.Register[2].Put16(3)
+		p.Register[3].Put16(16)
+		for _, tc := range []struct {
+			name string
+			inst uint16
+		}{
+			{"shl by 16", 0xa123},
+			{"shr by 16", 0xb123},
+			{"3 - 16", 0x9123},
+		} {
+			p.Register[1].Put16(77)
+			_, err := p.ExecuteInstruction(tc.inst, 0)
+			if trapped := codeOf(err) == FaultStrict; trapped != strict {
+				t.Errorf("strict %v: %s gave %v", strict, tc.name, err)
+			}
+			if strict && p.Register[1].Get16() != 77 {
+				t.Errorf("%s wrote its result despite the trap", tc.name)
+			}
+		}
+		p.Register[3].Put16(2)
+		if _, err := p.ExecuteInstruction(0x9123, 0); err != nil {
+			t.Errorf("strict %v: 3 - 2 gave %v", strict, err)
+		}
+	}
+}
+
+func TestLoadProgram(t *testing.T) {
+	a, err := Assemble("loop: set r1, 0xaaaa\nset r2, loop\njmp r2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := Assemble("set r1, 0xbbbb\nset r3, 7\nloop: set r2, loop\njmp r2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	p := NewProcessor(NewRAM(0x100), NewBootmedia(a, 0, 0), &testBus{}, nil)
+	if err := p.Boot(); err != nil {
+		t.Fatal(err)
+	}
+	tick, ints := NewManualTicker(), make(chan Interrupt)
+	p.Ticker, p.Ints = tick.C, ints
+	done := make(chan struct{})
+	go func() {
+		p.Run(make(chan error))
+		close(done)
+	}()
+	for range 4 {
+		tick.Tick()
+	}
+	if r1 := p.Registers()[1]; r1 != 0xaaaa {
+		t.Fatalf("r1 %x running A, want aaaa", r1)
+	}
+	if err := p.LoadProgram(NewBootmedia(b, 0, 0)); err != nil {
+		t.Fatal(err)
+	}
+	for range 4 {
+		tick.Tick()
+	}
+	close(ints)
+	<-done
+	if r1, r3 := p.Register[1].Get16(), p.Register[3].Get16(); r1 != 0xbbbb || r3 != 7 {
+		t.Errorf("r1 %x r3 %d after the swap, want bbbb and 7", r1, r3)
+	}
+}
+
+func TestMixedWidths(t *testing.T) {
+	p := newTestProcessor(t, `
+		set r1, 0x0002      ; 3 bytes
+		sbus r1             ; 1
+		smul r3, r4, r1, r1 ; 3
+		sbus r1             ; 1
+		add r5, r1, r1      ; 2
+		setb r6, 9          ; 3
+		rbus r1             ; 1
+	`)
+	for _, want := range []uint16{3, 4, 7, 8, 10, 13, 14} {
+		steps(t, p, 1)
+		if ip := p.Register[IP].Get16(); ip != want {
+			t.Fatalf("IP %d, want %d", ip, want)
+		}
+	}
+}
+
+// intBus is a testBus that keeps the interrupt chan for the test to raise on
+type intBus struct {
+	testBus
+	c chan<- Interrupt
+}
+
+func (b *intBus) Interrupts(c chan<- Interrupt) { b.c = c }
+
+func TestIntBuffer(t *testing.T) {
+	b := &intBus{}
+	NewProcessor(NewRAM(0x100), NewBootmedia(nil, 0, 0), b, nil, ProcessorOptions{IntBuffer: 2})
+	b.c <- Interrupt{BusAddr: 1}
+	b.c <- Interrupt{BusAddr: 2}
+	select {
+	case b.c <- Interrupt{BusAddr: 3}:
+		t.Error("raised a third interrupt into a buffer of two")
+	default:
+	}
+
+	for _, tc := range []struct {
+		policy IntPolicy
+		want   []uint8
+	}{
+		{IntDropOldest, []uint8{3, 4}},
+		{IntDropNewest, []uint8{1, 2}},
+	} {
+		b := &intBus{}
+		p := NewProcessor(NewRAM(0x100), NewBootmedia(nil, 0, 0), b, nil, ProcessorOptions{IntBuffer: 2, IntFull: tc.policy})
+		for i := range uint8(4) {
+			b.c <- Interrupt{BusAddr: i + 1} // Never blocks
+		}
+		// Reading before the relay has dealt with them all would make room
+		for deadline := time.Now().Add(time.Second); p.IntsDropped() < 2 && time.Now().Before(deadline); {
+			time.Sleep(time.Millisecond)
+		}
+		close(b.c)
+		var got []uint8
+		for i := range p.Ints {
+			got = append(got, i.BusAddr)
+		}
+		if !slices.Equal(got, tc.want) || p.IntsDropped() != 2 {
+			t.Errorf("policy %d kept %v dropping %d, want %v dropping 2", tc.policy, got, p.IntsDropped(), tc.want)
+		}
+	}
+}
+
+func TestBootBanks(t *testing.T) {
+	bios, err := Assemble("set r1, 0x1111")
+	if err != nil {
+		t.Fatal(err)
+	}
+	app, err := Assemble(".org 0x10\nset r1, 0x2222")
+	if err != nil {
+		t.Fatal(err)
+	}
+	m := newBankedRAM(2, 0x1000)
+	p := NewProcessor(m, NewBootmedia(bios, 0, 0), &testBus{}, nil)
+	if err := p.BootBank(0, NewBootmedia(bios, 0, 0)); err != nil {
+		t.Fatal(err)
+	}
+	if err := p.BootBank(1, NewBootmedia(app, 0, 0x10)); err != nil {
+		t.Fatal(err)
+	}
+	if b, _ := m.banks[0].Load8(0x10, 0); b != 0 {
+		t.Errorf("booting bank 1 wrote %x into bank 0", b)
+	}
+	for _, tc := range []struct {
+		bank   int
+		ip, r1 uint16
+	}{{0, 0, 0x1111}, {1, 0x10, 0x2222}, {0, 0, 0x1111}} {
+		if err := p.RunBank(tc.bank); err != nil {
+			t.Fatal(err)
+		}
+		if m.Bank() != tc.bank || p.Register[IP].Get16() != tc.ip {
+			t.Errorf("RunBank(%d) left bank %d IP %x", tc.bank, m.Bank(), p.Register[IP].Get16())
+		}
+		steps(t, &p, 1)
+		if r1 := p.Register[1].Get16(); r1 != tc.r1 {
+			t.Errorf("bank %d set r1 to %x, want %x", tc.bank, r1, tc.r1)
+		}
+	}
+}
+
+func TestCycles(t *testing.T) {
+	p := newTestProcessor(t, `
+		set r1, 0xfe02 ; CYCLES into r2
+		rbus r1
+		clr r3
+		set r4, 5
+		setb r5, 1
+		set r6, loop
+	loop:
+		add r3, r3, r5
+		ljump r3, r4, r6
+		set r1, 0xfe07 ; CYCLES into r7
+		rbus r1
+		sub r8, r7, r2
+	`)
+	steps(t, p, 2+4+10+3)
+	if r2 := p.Register[2].Get16(); r2 != 2 {
+		t.Errorf("first read %d, want 2 counting itself", r2)
+	}
+	// Setup, five times round the loop, and the second read
+	if d := p.Register[8].Get16(); d != 4+10+2 {
+		t.Errorf("%d cycles between reads, want 16", d)
+	}
+}
+
+func TestRloadRstore(t *testing.T) {
+	p := newTestProcessor(t, `
+		set r9, 0x1234
+		setb r1, 9
+		rload r2, r1
+		set r3, 0xabcd
+		setb r1, 10
+		rstore r3, r1
+		set r1, 16
+		rload r2, r1
+		setb r1, 6
+		rstore r3, r1
+	`)
+	steps(t, p, 3)
+	if r2 := p.Register[2].Get16(); r2 != 0x1234 {
+		t.Errorf("rload through r1=9 gave %#x", r2)
+	}
+	steps(t, p, 3)
+	if r10 := p.Register[10].Get16(); r10 != 0xabcd {
+		t.Errorf("rstore through r1=10 left %#x", r10)
+	}
+	steps(t, p, 1)
+	if err := p.execute(); codeOf(err) != FaultRegister {
+		t.Errorf("index 16 gave %v, want a register fault", err)
+	}
+	if r2 := p.Register[2].Get16(); r2 != 0x1234 {
+		t.Errorf("faulted rload changed r2 to %#x", r2)
+	}
+	// The index is checked against the limit like any named register
+	p.RegisterLimit = 6
+	steps(t, p, 1)
+	if err := p.execute(); codeOf(err) != FaultRegister {
+		t.Errorf("index 6 over a limit of 6 gave %v", err)
+	}
+	if r6 := p.Register[6].Get16(); r6 != 0 {
+		t.Errorf("faulted rstore wrote %#x to r6", r6)
+	}
+}
+
+func TestInterrupt(t *testing.T) {
+	p := newTestProcessor(t, spin)
+	p.Register[3].Put16(1)
+	steps(t, p, 2) // Back at loop
+	if err := p.Interrupt(Interrupt{BusAddr: 1, Handler: 5}); err != nil {
+		t.Fatal(err)
+	}
+	if ip := p.Register[IP].Get16(); ip != 5 {
+		t.Fatalf("IP at %d after the interrupt, want the handler at 5", ip)
+	}
+	steps(t, p, 2)
+	if r7, ip := p.Register[7].Get16(), p.Register[IP].Get16(); r7 != 1 || ip != 0 {
+		t.Errorf("handler left r7=%d and returned to %d, want 1 and 0", r7, ip)
+	}
+
+	// And from another goroutine while Run has the Processor
+	p = newTestProcessor(t, spin)
+	p.Register[3].Put16(1)
+	tick := make(chan time.Time)
+	close(tick)
+	p.Ticker = tick
+	ints := make(chan Interrupt)
+	p.Ints = ints
+	done := make(chan struct{})
+	go func() {
+		p.Run(make(chan error, 1))
+		close(done)
+	}()
+	if err := p.Interrupt(Interrupt{BusAddr: 1, Handler: 5}); err != nil {
+		t.Fatal(err)
+	}
+	deadline := time.Now().Add(time.Second)
+	for p.Registers()[7] == 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("handler never ran")
+		}
+		time.Sleep(time.Millisecond)
+	}
+	close(ints)
+	<-done
+}
+
+// readyBus has data waiting on bus ready, or on none if it's negative
+type readyBus struct {
+	testBus
+	ready int
+}
+
+func (b *readyBus) Which() (uint8, error) {
+	if b.ready < 0 {
+		return 0, errors.New("No bus has data")
+	}
+	return uint8(b.ready), nil
+}
+
+func TestWbusNoData(t *testing.T) {
+	p := newTestProcessor(t, "wbus r1\nwbus r1\nwbus r1")
+	b := &readyBus{ready: -1}
+	p.Bus = b
+	p.Register[1].Put16(0x0002) // Address into r2
+	p.Register[2].Put16(0x99)
+	steps(t, p, 1)
+	if p.Flags&FlagE == 0 || p.Register[2].Get16() != 0x99 {
+		t.Errorf("no data gave flags %x and r2 %#x, want E set and r2 untouched", p.Flags, p.Register[2].Get16())
+	}
+	b.ready = 0
+	steps(t, p, 1)
+	if p.Flags&FlagE != 0 || p.Register[2].Get16() != 0 {
+		t.Errorf("bus 0 gave flags %x and r2 %#x, want E clear and r2 0", p.Flags, p.Register[2].Get16())
+	}
+	b.ready = 3
+	p.Flags |= FlagC
+	steps(t, p, 1)
+	if p.Flags != FlagC || p.Register[2].Get16() != 3 {
+		t.Errorf("bus 3 gave flags %x and r2 %#x, want only C and r2 3", p.Flags, p.Register[2].Get16())
+	}
+}
+
+func TestRunUntil(t *testing.T) {
+	src := `
+		clr r1
+		set r2, 10
+		setb r3, 1
+		set r4, loop
+	loop:
+		add r1, r1, r3
+		ljump r1, r2, r4
+	mid:
+		set r5, 0x77
+	spin:
+		set r6, spin
+		jmp r6
+	`
+	_, syms, err := AssembleWithSymbols(src)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p := newTestProcessor(t, src)
+	if err := p.RunUntil(syms["loop"]); err != nil {
+		t.Fatal(err)
+	}
+	if err := p.RunUntil(syms["loop"]); err != nil || p.Register[1].Get16() != 1 {
+		t.Fatalf("once round the loop gave r1 %d, %v", p.Register[1].Get16(), err)
+	}
+	if err := p.RunUntil(syms["mid"]); err != nil {
+		t.Fatal(err)
+	}
+	if r1, r5 := p.Register[1].Get16(), p.Register[5].Get16(); r1 != 10 || r5 != 0 {
+		t.Errorf("at mid r1 is %d and r5 %#x, want 10 and 0", r1, r5)
+	}
+	p.StepLimit = 50
+	if err := p.RunUntil(0x1000); codeOf(err) != FaultStall {
+		t.Errorf("spinning gave %v, want a stall at the step limit", err)
+	}
+	if r5 := p.Register[5].Get16(); r5 != 0x77 {
+		t.Errorf("r5 is %#x past mid", r5)
+	}
+
+	p = newTestProcessor(t, "halt\nnop")
+	if err := p.RunUntil(4); err == nil {
+		t.Error("ran to 4 past a halt")
+	}
+}
+
+func TestNandNor(t *testing.T) {
+	// The low nibbles hold every pair of a and b bits, the rest are 0 and 0
+	p := newTestProcessor(t, `
+		setb r1, 0b1100
+		setb r2, 0b1010
+		nand r3, r1, r2
+		nor r4, r1, r2
+		set r5, 0xffff
+		nand r6, r5, r5
+		nor r7, r0, r0
+	`)
+	steps(t, p, 4)
+	if r3 := p.Register[3].Get16(); r3 != 0xfff7 { // 0111 in the low nibble
+		t.Errorf("nand gave %#04x, want 0xfff7", r3)
+	}
+	if r4 := p.Register[4].Get16(); r4 != 0xfff1 { // 0001
+		t.Errorf("nor gave %#04x, want 0xfff1", r4)
+	}
+	if p.Flags&(FlagN|FlagZ) != FlagN {
+		t.Errorf("nor of 0b1100 and 0b1010 set flags %x, want N", p.Flags)
+	}
+	steps(t, p, 2)
+	if r6 := p.Register[6].Get16(); r6 != 0 || p.Flags&(FlagN|FlagZ|FlagP) != FlagZ|FlagP {
+		t.Errorf("nand of all ones gave %#04x with flags %x, want 0 with Z and P", r6, p.Flags)
+	}
+	p.Flags |= FlagC | FlagV
+	steps(t, p, 1)
+	if r7 := p.Register[7].Get16(); r7 != 0xffff || p.Flags&(FlagN|FlagZ|FlagC|FlagV) != FlagN {
+		t.Errorf("nor of zeros gave %#04x with flags %x, want all ones with only N of N, Z, C and V", r7, p.Flags)
+	}
+}
+
+func TestStepNext(t *testing.T) {
+	p := newTestProcessor(t, `
+		set r1, there
+		setb r2, 1
+		ejump r0, r2, r1 ; Not taken
+		jmp r1
+		nop
+	there:
+		add r3, r2, r2
+	`)
+	for _, want := range []StepInfo{
+		{IP: 0, Next: 3},
+		{IP: 3, Next: 6},
+		{IP: 6, Next: 8},
+		{IP: 8, Next: 12},
+		{IP: 12, Next: 14},
+	} {
+		got, err := p.Step()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got != want {
+			t.Errorf("stepped %+v, want %+v", got, want)
+		}
+		if ip := p.Register[IP].Get16(); ip != got.Next {
+			t.Errorf("IP is %d, Next said %d", ip, got.Next)
+		}
+	}
+}
+
+func TestMulHighWord(t *testing.T) {
+	for _, hi := range []int{1, 5, 9, SP} {
+		for _, op := range []string{"mul", "smul"} {
+			p := newTestProcessor(t, fmt.Sprintf("%s r%d, r2, r3, r4", op, hi))
+			p.Register[3].Put16(0x1234)
+			p.Register[4].Put16(0x0100)
+			steps(t, p, 1)
+			if got, lo := p.Register[hi].Get16(), p.Register[2].Get16(); got != 0x0012 || lo != 0x3400 {
+				t.Errorf("%s into r%d:r2 gave %#04x:%#04x, want 0x0012:0x3400", op, hi, got, lo)
+			}
+			for r := range IP {
+				if r != hi && r != 2 && r != 3 && r != 4 && p.Register[r].Get16() != 0 {
+					t.Errorf("%s into r%d:r2 changed r%d", op, hi, r)
+				}
+			}
+		}
+	}
+	// The same register for both halves keeps the low one
+	p := newTestProcessor(t, "mul r5, r5, r3, r4")
+	p.Register[3].Put16(0x1234)
+	p.Register[4].Put16(0x0100)
+	steps(t, p, 1)
+	if r5 := p.Register[5].Get16(); r5 != 0x3400 {
+		t.Errorf("mul into r5:r5 left %#04x, want the low half", r5)
+	}
+}
+
+func TestOnSend(t *testing.T) {
+	p := newTestProcessor(t, `
+		set r1, 0x0203 ; Bus 2, data in r3
+		set r3, 0xbeef
+		sbus r1
+		set r1, 0xff03 ; Broadcast
+		sbus r1
+		set r1, 0x0503
+		sbusb r1
+	`)
+	type send struct {
+		bus  uint8
+		data uint16
+	}
+	var got []send
+	p.OnSend = func(bus uint8, data uint16) { got = append(got, send{bus, data}) }
+	steps(t, p, 7)
+	want := []send{{2, 0xbeef}, {BROADCAST, 0xbeef}, {5, 0xef}}
+	if !slices.Equal(got, want) {
+		t.Errorf("OnSend saw %v, want %v", got, want)
+	}
+
+	// Nothing delivered, nothing reported
+	got = nil
+	p.Bus = &deadBus{}
+	p.Register[IP].Put16(0)
+	steps(t, p, 2)
+	if err := p.execute(); codeOf(err) != FaultBus {
+		t.Fatalf("send to a dead bus gave %v", err)
+	}
+	if len(got) != 0 {
+		t.Errorf("OnSend saw %v for a failed send", got)
+	}
+}
+
+func TestNeg(t *testing.T) {
+	for _, tc := range []struct {
+		src, want uint16
+		flags     uint16 // Of Z, C, N and V
+	}{
+		{0, 0, FlagZ},
+		{5, 0xfffb, FlagC | FlagN},
+		{0xfffb, 5, FlagC},
+		{0x8000, 0x8000, FlagC | FlagN | FlagV}, // No positive twin
+	} {
+		p := newTestProcessor(t, "neg r1, r2")
+		p.Saturate = true // Mustn't clamp
+		p.Register[2].Put16(tc.src)
+		steps(t, p, 1)
+		if got := p.Register[1].Get16(); got != tc.want {
+			t.Errorf("neg %#04x gave %#04x, want %#04x", tc.src, got, tc.want)
+		}
+		if got := p.Flags & (FlagZ | FlagC | FlagN | FlagV); got != tc.flags {
+			t.Errorf("neg %#04x set flags %x, want %x", tc.src, got, tc.flags)
+		}
+		if r2 := p.Register[2].Get16(); r2 != tc.src {
+			t.Errorf("neg %#04x changed its source to %#04x", tc.src, r2)
+		}
+	}
+}
+
+func TestPred(t *testing.T) {
+	for _, tc := range []struct {
+		cond  string
+		flags uint16
+		runs  bool
+	}{
+		{"z", FlagZ, true},
+		{"z", 0, false},
+		{"nz", 0, true},
+		{"nz", FlagZ | FlagC, false},
+		{"c", FlagZ | FlagC, true}, // Only the masked flag counts
+	} {
+		p := newTestProcessor(t, "pred "+tc.cond+"\nadd r2, r3, r3\nsetb r4, 1")
+		p.Register[3].Put16(5)
+		p.Flags = tc.flags
+		steps(t, p, 1)
+		next := uint16(3) // The add
+		if !tc.runs {
+			next = 5 // Past it
+		}
+		if ip := p.Register[IP].Get16(); ip != next {
+			t.Errorf("pred %s with flags %x: IP %d, want %d", tc.cond, tc.flags, ip, next)
+		}
+		steps(t, p, 1)
+		r2, r4 := uint16(0), uint16(1) // Skipped, so the setb ran second
+		if tc.runs {
+			r2, r4 = 10, 0
+		}
+		if got2, got4 := p.Register[2].Get16(), p.Register[4].Get16(); got2 != r2 || got4 != r4 {
+			t.Errorf("pred %s with flags %x: r2 %d r4 %d, want %d and %d", tc.cond, tc.flags, got2, got4, r2, r4)
+		}
+	}
+}
+
+func TestPopcntParity(t *testing.T) {
+	for _, tc := range []struct {
+		src, want uint16
+	}{
+		{0x0000, 0},
+		{0xffff, 16},
+		{0xaaaa, 8},
+		{0x8001, 2},
+		{0x0007, 3},
+	} {
+		p := newTestProcessor(t, "popcnt r1, r2")
+		p.Register[2].Put16(tc.src)
+		steps(t, p, 1)
+		if got := p.Register[1].Get16(); got != tc.want {
+			t.Errorf("popcnt %#04x gave %d, want %d", tc.src, got, tc.want)
+		}
+	}
+
+	// P is set when an ALU result has an even number of bits set
+	for _, tc := range []struct {
+		a, b uint16
+		even bool
+	}{
+		{0, 0, true}, // No bits at all
+		{1, 0, false},
+		{1, 2, true},
+		{0xfffe, 1, true},
+		{0x7ffe, 1, false},
+	} {
+		p := newTestProcessor(t, "add r1, r2, r3\nxor r4, r2, r3")
+		p.Register[2].Put16(tc.a)
+		p.Register[3].Put16(tc.b)
+		steps(t, p, 1)
+		if even := p.Flags&FlagP != 0; even != tc.even {
+			t.Errorf("add %#x, %#x: parity flag %v, want %v", tc.a, tc.b, even, tc.even)
+		}
+		p.Flags ^= FlagP
+		steps(t, p, 1) // Same bits, since a and b don't overlap
+		if even := p.Flags&FlagP != 0; even != tc.even {
+			t.Errorf("xor %#x, %#x: parity flag %v, want %v", tc.a, tc.b, even, tc.even)
+		}
+	}
+}
+
+func TestIPOverflow(t *testing.T) {
+	for _, tc := range []struct {
+		name string
+		at   uint16
+		code []uint8
+		wrap uint16 // Where the IP ends up when it wraps
+		trap bool   // Whether TrapIPOverflow stops it
+	}{
+		{"add", 0xfffe, []uint8{0x81, 0x23}, 0, true},
+		{"set", 0xfffd, []uint8{0x21, 0x00, 0x05}, 0, true},
+		{"sbus short of the top", 0xfffe, []uint8{0x42}, 0xffff, false},
+		{"jmp", 0xfffe, []uint8{0x71, 0x11}, 0x10, false},
+	} {
+		for _, trap := range []bool{false, true} {
+			p := newTestProcessor(t, "nop")
+			p.TrapIPOverflow = trap
+			for i, b := range tc.code {
+				p.Memory.Save8(tc.at, uint16(i), b)
+			}
+			p.Register[1].Put16(0x10)
+			p.Register[IP].Put16(tc.at)
+			err := p.execute()
+			ip := p.Register[IP].Get16()
+			if trap && tc.trap {
+				if codeOf(err) != FaultMemory || ip != tc.at {
+					t.Errorf("%s trapping: %v with the IP at %#x, want a memory fault at %#x", tc.name, err, ip, tc.at)
+				}
+				continue
+			}
+			if err != nil || ip != tc.wrap {
+				t.Errorf("%s, trap %v: %v with the IP at %#x, want %#x", tc.name, trap, err, ip, tc.wrap)
+			}
+		}
+	}
+}
+
+// wordBus is a testBus with a word waiting on every bus
+type wordBus struct{ testBus }
+
+func (b *wordBus) Recv(addr uint8) (uint16, error) { return 0x1234, nil }
+
+// byteBus is a wordBus that also takes byte transfers, keeping them apart
+type byteBus struct {
+	wordBus
+	bytes []uint8
+}
+
+func (b *byteBus) Send8(addr, data uint8) error {
+	b.bytes = append(b.bytes, data)
+	return nil
+}
+
+func (b *byteBus) Recv8(addr uint8) (uint8, error) { return 0x5a, nil }
+
+func TestByteTransfers(t *testing.T) {
+	src := `
+		set r1, 0x0302 ; Bus 3, r2
+		set r2, 0xabcd
+		sbusb r1
+		rbusb r1
+	`
+	// A plain bus moves words: the high byte goes out as 0 and is dropped
+	// coming in
+	w := &wordBus{}
+	p := newTestProcessor(t, src)
+	p.Bus = w
+	steps(t, p, 3)
+	if !slices.Equal(w.sent, []uint16{0x00cd}) {
+		t.Errorf("sbusb on a word bus sent %x, want [cd]", w.sent)
+	}
+	steps(t, p, 1)
+	if r2 := p.Register[2].Get16(); r2 != 0x0034 {
+		t.Errorf("rbusb on a word bus read %#04x, want 0x0034", r2)
+	}
+
+	b := &byteBus{}
+	p = newTestProcessor(t, src)
+	p.Bus = b
+	steps(t, p, 3)
+	if len(b.sent) != 0 || !bytes.Equal(b.bytes, []uint8{0xcd}) {
+		t.Errorf("sbusb on a byte bus sent words %x and bytes %x, want just the byte cd", b.sent, b.bytes)
+	}
+	steps(t, p, 1)
+	if r2 := p.Register[2].Get16(); r2 != 0x005a {
+		t.Errorf("rbusb on a byte bus read %#04x, want 0x005a", r2)
+	}
+}
+
+func TestCoverage(t *testing.T) {
+	src := `
+		setb r1, 1
+		set r2, skip
+		ejump r1, r1, r2
+	skipped:
+		set r3, 5 ; The path not taken
+	skip:
+		add r4, r1, r1
+		halt
+	`
+	_, syms, err := AssembleWithSymbols(src)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p := newTestProcessor(t, src)
+	if p.Coverage() != nil {
+		t.Error("coverage without TrackCoverage")
+	}
+	p.TrackCoverage = true
+	for !p.Halted() {
+		steps(t, p, 1)
+	}
+	cov := p.Coverage()
+	var reached []uint16
+	for addr, hit := range cov {
+		if hit {
+			reached = append(reached, uint16(addr))
+		}
+	}
+	if want := []uint16{0, 3, 6, syms["skip"], syms["skip"] + 2}; !slices.Equal(reached, want) {
+		t.Errorf("reached %v, want %v", reached, want)
+	}
+	if cov[syms["skipped"]] {
+		t.Error("the skipped set marked as reached")
+	}
+
+	cov[0] = false // A copy, so this changes nothing
+	if !p.Coverage()[0] {
+		t.Error("Coverage handed out its own slice")
+	}
+	if err := p.Boot(); err != nil {
+		t.Fatal(err)
+	}
+	if p.Coverage() != nil {
+		t.Error("coverage kept across Boot")
+	}
+}
+
+func TestIntSource(t *testing.T) {
+	p := newTestProcessor(t, `
+	loop:
+		set r2, loop
+		jmp r2
+	handler:
+		set r1, 0xfd03 ; INTSOURCE into r3
+		rbus r1
+		set r1, 0x0903 ; Then out on bus 9
+		sbus r1
+		iret
+	`)
+	steps(t, p, 2)
+	for _, bus := range []uint8{3, 7} {
+		if err := p.Interrupt(Interrupt{BusAddr: bus, Handler: 5}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	steps(t, p, 10) // Both handlers, one after the other
+	if sent := p.Bus.(*testBus).sent; !slices.Equal(sent, []uint16{3, 7}) {
+		t.Errorf("handlers read sources %v, want [3 7]", sent)
+	}
+	if ip := p.Register[IP].Get16(); ip != 0 {
+		t.Errorf("IP at %d after both handlers, want back at 0", ip)
+	}
+	p.Register[IP].Put16(5)
+	if err := p.execute(); err != nil {
+		t.Fatal(err)
+	}
+	if err := p.execute(); codeOf(err) != FaultInterrupt {
+		t.Errorf("INTSOURCE outside a handler gave %v", err)
+	}
+}
+
+func TestHalted(t *testing.T) {
+	p := newTestProcessor(t, "setb r1, 1\nadd r1, r1, r1\nhalt\nsetb r1, 9")
+	tick := make(chan time.Time)
+	close(tick)
+	p.Ticker = tick
+	steps(t, p, 2)
+	if p.Halted() {
+		t.Fatal("halted before the halt")
+	}
+	p.Run(make(chan error, 1)) // Returns at the halt
+	if !p.Halted() {
+		t.Fatal("not halted once Run returned")
+	}
+	if r1 := p.Register[1].Get16(); r1 != 2 {
+		t.Errorf("r1 is %d, ran past the halt", r1)
+	}
+	if err := p.execute(); err == nil {
+		t.Error("executed while halted")
+	}
+	if err := p.WarmReset(); err != nil {
+		t.Fatal(err)
+	}
+	if p.Halted() {
+		t.Error("still halted after a reset")
+	}
+}
+
+func TestRegisters(t *testing.T) {
+	p := newTestProcessor(t, `
+		set r1, 0x1234
+		setb r2, 3
+		sub r3, r0, r2
+		shl r4, r1, r2
+		set sp, 0x200
+		push r1
+	`)
+	steps(t, p, 6)
+	regs := p.Registers()
+	for i := range p.Register {
+		if got := p.Register[i].Get16(); regs[i] != got {
+			t.Errorf("Registers has r%d %#04x, reading it gives %#04x", i, regs[i], got)
+		}
+	}
+	if regs[3] != 0xfffd || regs[SP] != 0x1fe || regs[IP] != 15 {
+		t.Errorf("got r3 %#x SP %#x IP %d, want 0xfffd, 0x1fe and 15", regs[3], regs[SP], regs[IP])
+	}
+	regs[1] = 0 // A snapshot, so this changes nothing
+	if r1 := p.Register[1].Get16(); r1 != 0x1234 {
+		t.Errorf("changing the snapshot set r1 to %#x", r1)
+	}
+}
+
+func TestInterruptKeepsStack(t *testing.T) {
+	src := `
+		set sp, 0x200
+		set r1, 0x1111
+		push r1
+		set r1, 0x2222
+		push r1
+		setb r2, 5
+		setb r3, 3
+		sub r4, r3, r2 ; Borrow, so C and N
+		pop r6
+		pop r7
+		halt
+	handler:
+		push r2 ; The handler uses the stack too
+		clr r8
+		getf r9
+		pop r2
+		iret
+	`
+	_, syms, err := AssembleWithSymbols(src)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p := newTestProcessor(t, src)
+	steps(t, p, 8) // Through the sub
+	flags, sp := p.Flags, p.Register[SP].Get16()
+	if err := p.Interrupt(Interrupt{BusAddr: 3, Handler: syms["handler"]}); err != nil {
+		t.Fatal(err)
+	}
+	if got := p.Register[SP].Get16(); got != sp {
+		t.Errorf("taking the interrupt moved SP from %#x to %#x", sp, got)
+	}
+	steps(t, p, 5)
+	if p.Register[9].Get16()&FlagZ == 0 {
+		t.Error("handler's clr didn't set Z")
+	}
+	if p.Flags != flags || p.Register[SP].Get16() != sp {
+		t.Errorf("after IRET flags %x SP %#x, want %x and %#x", p.Flags, p.Register[SP].Get16(), flags, sp)
+	}
+	if got, _ := p.Memory.Load16(sp-2, 0); got != 5 {
+		t.Errorf("found %#x under the stack, want the handler's push of 5", got)
+	}
+	steps(t, p, 3)
+	if r6, r7 := p.Register[6].Get16(), p.Register[7].Get16(); r6 != 0x2222 || r7 != 0x1111 || !p.Halted() {
+		t.Errorf("popped %#x and %#x, want 0x2222 and 0x1111", r6, r7)
+	}
+}
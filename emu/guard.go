@@ -0,0 +1,64 @@
+package emu
+
+// GuardedMemory asks a policy about every access before passing it on to
+// the Memory it wraps. The policy sees the effective address, width,
+// direction and any data being stored; it can deny the access by returning false, or redirect it by
+// changing the address.
+type GuardedMemory struct {
+	inner  Memory
+	policy func(a *Access) bool
+}
+
+// NewGuardedMemory wraps m so that policy is consulted on every access
+func NewGuardedMemory(m Memory, policy func(a *Access) bool) *GuardedMemory {
+	return &GuardedMemory{m, policy}
+}
+
+// check runs the policy and returns the address to use
+func (g *GuardedMemory) check(addr, offset uint16, width uint8, write bool, data uint16) (uint16, error) {
+	a := Access{Addr: addr + offset, Width: width, Write: write, Data: data}
+	if !g.policy(&a) {
+		msg := "Read denied by policy"
+		if write {
+			msg = "Write denied by policy"
+		}
+		return 0, ProcError{msg, FaultMemory, addr, offset, nil, nil}
+	}
+	return a.Addr, nil
+}
+
+// Load8 return a byte
+func (g *GuardedMemory) Load8(addr, offset uint16) (uint8, error) {
+	a, err := g.check(addr, offset, 1, false, 0)
+	if err != nil {
+		return 0, err
+	}
+	return g.inner.Load8(a, 0)
+}
+
+// Load16 returns 2 bytes
+func (g *GuardedMemory) Load16(addr, offset uint16) (uint16, error) {
+	a, err := g.check(addr, offset, 2, false, 0)
+	if err != nil {
+		return 0, err
+	}
+	return g.inner.Load16(a, 0)
+}
+
+// Save8 stores a byte
+func (g *GuardedMemory) Save8(addr, offset uint16, data uint8) error {
+	a, err := g.check(addr, offset, 1, true, uint16(data))
+	if err != nil {
+		return err
+	}
+	return g.inner.Save8(a, 0, data)
+}
+
+// Save16 stores 2 bytes
+func (g *GuardedMemory) Save16(addr, offset, data uint16) error {
+	a, err := g.check(addr, offset, 2, true, data)
+	if err != nil {
+		return err
+	}
+	return g.inner.Save16(a, 0, data)
+}
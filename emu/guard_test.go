@@ -0,0 +1,42 @@
+package emu
+
+import "testing"
+
+func TestGuardedMemory(t *testing.T) {
+	code, err := Assemble(`
+		set r1, 0x100
+		store r2, r1
+		set r1, 0x200
+		store r2, r1 ; Denied
+		load r3, r1
+		set r1, 0x400
+		load r4, r1 ; Redirected to 0x100
+	`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ram := NewRAM(0x1000)
+	ram.Save16(0x200, 0, 0x1234)
+	policy := func(a *Access) bool {
+		if a.Addr == 0x400 {
+			a.Addr = 0x100
+		}
+		return !a.Write || a.Addr < 0x200 || a.Addr >= 0x300
+	}
+	p := NewProcessor(NewGuardedMemory(ram, policy), NewBootmedia(code, 0, 0), &testBus{}, nil)
+	if err := p.Boot(); err != nil {
+		t.Fatal(err)
+	}
+	p.Register[2].Put16(0xbeef)
+	steps(t, &p, 3)
+	if err := p.execute(); codeOf(err) != FaultMemory {
+		t.Fatalf("denied store gave %v, want a memory fault", err)
+	}
+	if w, _ := ram.Load16(0x200, 0); w != 0x1234 {
+		t.Errorf("denied store changed memory to %x", w)
+	}
+	steps(t, &p, 3)
+	if r3, r4 := p.Register[3].Get16(), p.Register[4].Get16(); r3 != 0x1234 || r4 != 0xbeef {
+		t.Errorf("loads gave %x and %x, want 1234 and beef", r3, r4)
+	}
+}
@@ -0,0 +1,228 @@
+package emu
+
+import (
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"maps"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// ParseProgram reads a program in the text hex format: hex bytes separated
+// by whitespace or commas. The first two bytes are the offset to load the
+// rest at and the next two are the initial IP, both big endian.
+//
+// A token of more than two digits is several bytes, in the order written:
+// 1234 is 12 34, the same as a big endian word. Tokens need an even number
+// of digits.
+//
+// A # starts a comment running to the end of the line, wherever it appears,
+// even in the middle of a byte. /* */ comments may span several lines.
+//
+// Register seeds and relocations (see ParseImage) are accepted but dropped.
+func ParseProgram(raw []byte) (data []uint8, offset uint16, pointer uint16, err error) {
+	return ParseProgramOrder(raw, binary.BigEndian)
+}
+
+// ParseProgramOrder is ParseProgram with the header read in the given byte
+// order, binary.BigEndian or binary.LittleEndian. Memory itself is always
+// big endian; only the header changes.
+func ParseProgramOrder(raw []byte, order binary.ByteOrder) (data []uint8, offset uint16, pointer uint16, err error) {
+	img, err := ParseImage(raw, order)
+	return img.Data, img.Offset, img.Start, err
+}
+
+// Image is a parsed program file
+type Image struct {
+	Data        []uint8
+	Offset      uint16 // Where Data loads
+	Start       uint16 // Initial IP
+	Registers   map[uint8]uint16
+	Relocations []uint16 // Positions in Data of words to add Offset to
+}
+
+// Bootmedia wraps the image for Boot, with its register seeds and
+// relocations if it has any
+func (img Image) Bootmedia() Bootmedia {
+	if len(img.Relocations) > 0 {
+		return &relocBootmedia{&registerBootmedia{NewBootmedia(img.Data, img.Offset, img.Start).(*sliceBootmedia), img.Registers}, img.Relocations}
+	}
+	if len(img.Registers) > 0 {
+		return NewRegisterBootmedia(img.Data, img.Offset, img.Start, img.Registers)
+	}
+	return NewBootmedia(img.Data, img.Offset, img.Start)
+}
+
+// ParseImage is ParseProgramOrder, also reading register seeds and
+// relocations. A seed is a token like r3=1f00 anywhere in the file, setting
+// the register (r0 - r14, decimal) to the hex value once the program boots.
+// A relocation is a token like @0004, marking the word that many bytes (in
+// hex) into the program, not counting the header, as an address that
+// assumes the program loads at 0. Boot adds the real offset to it, so the
+// same program can be loaded anywhere by changing the header. Neither are
+// bytes of the program and they may be given in any order, but each
+// register or position only once.
+func ParseImage(raw []byte, order binary.ByteOrder) (img Image, err error) {
+	if order != binary.BigEndian && order != binary.LittleEndian {
+		return Image{}, fmt.Errorf("Unsupported header byte order %v", order)
+	}
+	var data []uint8
+	holder := ""
+	flush := func() error {
+		if holder == "" {
+			return nil
+		}
+		if at, ok := strings.CutPrefix(holder, "@"); ok {
+			if err := img.relocation(at); err != nil {
+				return err
+			}
+			holder = ""
+			return nil
+		}
+		if reg, value, ok := strings.Cut(holder, "="); ok {
+			if err := img.seed(reg, value); err != nil {
+				return err
+			}
+			holder = ""
+			return nil
+		}
+		b, e := hex.DecodeString(holder)
+		if e != nil {
+			return fmt.Errorf("Bad hex %q: %s", holder, e)
+		}
+		data = append(data, b...)
+		holder = ""
+		return nil
+	}
+	for i := 0; i < len(raw); i++ {
+		switch {
+		case raw[i] == '#':
+			// Comment, skip to the newline
+			for i < len(raw) && raw[i] != '\n' {
+				i++
+			}
+		case raw[i] == '/' && i+1 < len(raw) && raw[i+1] == '*':
+			end := strings.Index(string(raw[i+2:]), "*/")
+			if end < 0 {
+				return Image{}, errors.New("Unterminated /* comment")
+			}
+			i += end + 3 // Land on the closing /
+		case raw[i] == '\n' || raw[i] == '\r' || raw[i] == '\t' || raw[i] == ' ' || raw[i] == ',':
+		default:
+			holder += string(raw[i])
+			continue
+		}
+		// Anything but a hex digit ends the current token
+		if err = flush(); err != nil {
+			return Image{}, err
+		}
+	}
+	if err = flush(); err != nil {
+		return Image{}, err
+	}
+	if len(data) < 5 {
+		return Image{}, errors.New("Not enough data to run a program")
+	}
+	img.Offset = order.Uint16(data[0:2])
+	img.Start = order.Uint16(data[2:4])
+	img.Data = data[4:]
+	for _, at := range img.Relocations {
+		if int(at)+2 > len(img.Data) {
+			return Image{}, fmt.Errorf("Relocation @%04x is past the end of the program", at)
+		}
+	}
+
+	return
+}
+
+// relocation records a relocation token, minus its @
+func (img *Image) relocation(at string) error {
+	v, err := strconv.ParseUint(at, 16, 16)
+	if err != nil {
+		return fmt.Errorf("Bad relocation %q: %s", "@"+at, err)
+	}
+	for _, r := range img.Relocations {
+		if r == uint16(v) {
+			return fmt.Errorf("Relocation @%04x given twice", v)
+		}
+	}
+	img.Relocations = append(img.Relocations, uint16(v))
+	return nil
+}
+
+// seed records a register seed token split at its =
+func (img *Image) seed(reg, value string) error {
+	n, err := strconv.ParseUint(strings.TrimPrefix(strings.ToLower(reg), "r"), 10, 8)
+	if err != nil || !strings.HasPrefix(strings.ToLower(reg), "r") || n >= IP {
+		return fmt.Errorf("Bad register %q in seed, want r0 - r14", reg)
+	}
+	v, err := strconv.ParseUint(value, 16, 16)
+	if err != nil {
+		return fmt.Errorf("Bad value %q for %s: %s", value, reg, err)
+	}
+	if _, ok := img.Registers[uint8(n)]; ok {
+		return fmt.Errorf("Register %s seeded twice", reg)
+	}
+	if img.Registers == nil {
+		img.Registers = map[uint8]uint16{}
+	}
+	img.Registers[uint8(n)] = uint16(v)
+	return nil
+}
+
+// HexFormat changes how WriteHexProgram and WriteHex lay a program out.
+// The zero value comments the header and each line of data.
+type HexFormat struct {
+	Bare bool // Leave the comments out, writing only the tokens
+}
+
+// WriteHexProgram writes a program in the text hex format ParseProgram
+// reads: the big endian offset and IP header, then the data perLine bytes
+// to a line, each line followed by a comment with the address its first
+// byte loads at unless the format is Bare.
+func WriteHexProgram(w io.Writer, data []byte, offset, pointer uint16, perLine int, opts ...HexFormat) error {
+	return Image{Data: data, Offset: offset, Start: pointer}.WriteHex(w, perLine, opts...)
+}
+
+// WriteHex is WriteHexProgram for a whole image. Register seeds, lowest
+// register first, and relocations follow the header as tokens ParseImage
+// reads back.
+func (img Image) WriteHex(w io.Writer, perLine int, opts ...HexFormat) error {
+	if perLine <= 0 {
+		return fmt.Errorf("Bytes per line must be positive, got %d", perLine)
+	}
+	var f HexFormat
+	if len(opts) > 0 {
+		f = opts[0]
+	}
+	comment := func(c string) string {
+		if f.Bare {
+			return "\n"
+		}
+		return " # " + c + "\n"
+	}
+	_, err := fmt.Fprintf(w, "%02x %02x%s%02x %02x%s", img.Offset>>8, img.Offset&0xFF, comment("offset"), img.Start>>8, img.Start&0xFF, comment("start"))
+	if len(img.Registers) > 0 && err == nil {
+		var seeds []string
+		for _, r := range slices.Sorted(maps.Keys(img.Registers)) {
+			seeds = append(seeds, fmt.Sprintf("r%d=%04x", r, img.Registers[r]))
+		}
+		_, err = fmt.Fprint(w, strings.Join(seeds, " ")+comment("registers"))
+	}
+	if len(img.Relocations) > 0 && err == nil {
+		var relocs []string
+		for _, at := range img.Relocations {
+			relocs = append(relocs, fmt.Sprintf("@%04x", at))
+		}
+		_, err = fmt.Fprint(w, strings.Join(relocs, " ")+comment("relocations"))
+	}
+	for i := 0; i < len(img.Data) && err == nil; i += perLine {
+		line := img.Data[i:min(i+perLine, len(img.Data))]
+		_, err = fmt.Fprintf(w, "% x%s", line, comment(fmt.Sprintf("%04x", img.Offset+uint16(i))))
+	}
+	return err
+}
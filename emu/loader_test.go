@@ -0,0 +1,136 @@
+package emu
+
+import (
+	"bytes"
+	"encoding/binary"
+	"reflect"
+	"testing"
+)
+
+func TestParseProgramComments(t *testing.T) {
+	src := `00 00 00 02 # Header
+ab#cd is a comment, even mid-byte
+/* A block
+   45 45 over lines */ 12,/**/34
+56 /* inline */ 78`
+	data, offset, ip, err := ParseProgram([]byte(src))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if offset != 0 || ip != 2 {
+		t.Errorf("header gave offset %x IP %x, want 0 and 2", offset, ip)
+	}
+	if want := []uint8{0xab, 0x12, 0x34, 0x56, 0x78}; !bytes.Equal(data, want) {
+		t.Errorf("got % x, want % x", data, want)
+	}
+	if _, _, _, err := ParseProgram([]byte("00 00 00 00 01 /* 02")); err == nil {
+		t.Error("unterminated block comment parsed")
+	}
+}
+
+func TestLittleEndianHeader(t *testing.T) {
+	src := []byte("10 00 02 00 ab cd")
+	data, offset, ip, err := ParseProgramOrder(src, binary.LittleEndian)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if offset != 0x0010 || ip != 0x0002 {
+		t.Errorf("little endian header gave offset %x IP %x, want 10 and 2", offset, ip)
+	}
+	if !bytes.Equal(data, []uint8{0xab, 0xcd}) {
+		t.Errorf("data % x, want ab cd whatever the header order", data)
+	}
+	if _, offset, ip, _ = ParseProgramOrder(src, binary.BigEndian); offset != 0x1000 || ip != 0x0200 {
+		t.Errorf("big endian header gave offset %x IP %x, want 1000 and 200", offset, ip)
+	}
+}
+
+func TestWriteHexProgramRoundTrip(t *testing.T) {
+	src := "01 00 01 04 # Header\nde ad be ef /* gap */ 00 01 02\n03 04 05"
+	data, offset, ip, err := ParseProgram([]byte(src))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, perLine := range []int{1, 4, 16} {
+		var first, second bytes.Buffer
+		if err := WriteHexProgram(&first, data, offset, ip, perLine); err != nil {
+			t.Fatal(err)
+		}
+		again, againOffset, againIP, err := ParseProgram(first.Bytes())
+		if err != nil {
+			t.Fatalf("%d per line: %v\n%s", perLine, err, first.String())
+		}
+		if !bytes.Equal(again, data) || againOffset != offset || againIP != ip {
+			t.Errorf("%d per line parsed back to % x at %x IP %x", perLine, again, againOffset, againIP)
+		}
+		if err := WriteHexProgram(&second, again, againOffset, againIP, perLine); err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(first.Bytes(), second.Bytes()) {
+			t.Errorf("%d per line wrote\n%s\nthen\n%s", perLine, first.String(), second.String())
+		}
+	}
+	var b bytes.Buffer
+	WriteHexProgram(&b, data[:6], offset, ip, 4)
+	want := "01 00 # offset\n01 04 # start\nde ad be ef # 0100\n00 01 # 0104\n"
+	if b.String() != want {
+		t.Errorf("wrote\n%s\nwant\n%s", b.String(), want)
+	}
+	if err := WriteHexProgram(&b, data, offset, ip, 0); err == nil {
+		t.Error("0 bytes per line accepted")
+	}
+	b.Reset()
+	WriteHexProgram(&b, data[:6], offset, ip, 4, HexFormat{Bare: true})
+	if want := "01 00\n01 04\nde ad be ef\n00 01\n"; b.String() != want {
+		t.Errorf("bare wrote\n%s\nwant\n%s", b.String(), want)
+	}
+}
+
+func TestWriteHexSeedsRelocations(t *testing.T) {
+	src := "00 10 00 10 @0002 r5=00ff 20 00 00 04 r1=beef"
+	img, err := ParseImage([]byte(src), binary.BigEndian)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var b bytes.Buffer
+	if err := img.WriteHex(&b, 8); err != nil {
+		t.Fatal(err)
+	}
+	want := "00 10 # offset\n00 10 # start\nr1=beef r5=00ff # registers\n@0002 # relocations\n20 00 00 04 # 0010\n"
+	if b.String() != want {
+		t.Errorf("wrote\n%s\nwant\n%s", b.String(), want)
+	}
+	again, err := ParseImage(b.Bytes(), binary.BigEndian)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(again, img) {
+		t.Errorf("parsed back to %+v, want %+v", again, img)
+	}
+}
+
+func TestWideTokens(t *testing.T) {
+	for _, tc := range []struct {
+		src  string
+		want []uint8
+	}{
+		{"0000 0002 ab cd", []uint8{0xab, 0xcd}},
+		{"0000 0002 abcd", []uint8{0xab, 0xcd}},
+		{"00 00 00 02 1234 56 789a", []uint8{0x12, 0x34, 0x56, 0x78, 0x9a}},
+		{"00000002 beef", []uint8{0xbe, 0xef}}, // Header in one token
+	} {
+		data, offset, ip, err := ParseProgram([]byte(tc.src))
+		if err != nil {
+			t.Errorf("%q: %v", tc.src, err)
+			continue
+		}
+		if offset != 0 || ip != 2 || !bytes.Equal(data, tc.want) {
+			t.Errorf("%q parsed to % x at %x IP %x, want % x at 0 IP 2", tc.src, data, offset, ip, tc.want)
+		}
+	}
+	for _, bad := range []string{"0000 0002 123", "0000 0002 1", "0000 0002 12g4"} {
+		if _, _, _, err := ParseProgram([]byte(bad)); err == nil {
+			t.Errorf("%q parsed", bad)
+		}
+	}
+}
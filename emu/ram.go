@@ -0,0 +1,76 @@
+package emu
+
+import "fmt"
+
+// RAM is plain byte addressed memory, for hosts that don't need anything
+// fancier than a flat address space starting at 0
+type RAM struct {
+	data []uint8
+}
+
+// NewRAM makes size bytes of zeroed RAM. size can be up to 0x10000, the
+// whole address space.
+func NewRAM(size uint32) *RAM {
+	if size > 0x10000 {
+		panic(fmt.Sprintf("RAM size %x is more than the address space", size))
+	}
+	return &RAM{make([]uint8, size)}
+}
+
+// Size returns how many bytes there are
+func (r *RAM) Size() uint32 {
+	return uint32(len(r.data))
+}
+
+// check finds the index of an access of width bytes, refusing any that
+// would run past the end rather than wrapping around
+func (r *RAM) check(addr, offset uint16, width uint32, write bool) (uint32, error) {
+	at := uint32(addr) + uint32(offset)
+	if at+width > uint32(len(r.data)) {
+		msg := "Load past end of RAM"
+		if write {
+			msg = "Save past end of RAM"
+		}
+		return 0, ProcError{msg, FaultMemory, addr, offset, nil, nil}
+	}
+	return at, nil
+}
+
+// Load8 return a byte
+func (r *RAM) Load8(addr, offset uint16) (uint8, error) {
+	at, err := r.check(addr, offset, 1, false)
+	if err != nil {
+		return 0, err
+	}
+	return r.data[at], nil
+}
+
+// Load16 returns 2 bytes
+func (r *RAM) Load16(addr, offset uint16) (uint16, error) {
+	at, err := r.check(addr, offset, 2, false)
+	if err != nil {
+		return 0, err
+	}
+	return uint16(r.data[at])<<8 | uint16(r.data[at+1]), nil
+}
+
+// Save8 stores a byte
+func (r *RAM) Save8(addr, offset uint16, data uint8) error {
+	at, err := r.check(addr, offset, 1, true)
+	if err != nil {
+		return err
+	}
+	r.data[at] = data
+	return nil
+}
+
+// Save16 stores 2 bytes
+func (r *RAM) Save16(addr, offset, data uint16) error {
+	at, err := r.check(addr, offset, 2, true)
+	if err != nil {
+		return err
+	}
+	r.data[at] = uint8(data >> 8)
+	r.data[at+1] = uint8(data)
+	return nil
+}
@@ -0,0 +1,58 @@
+package emu
+
+import "testing"
+
+func TestRAMBoundaries(t *testing.T) {
+	for _, tc := range []struct {
+		size uint32
+		last uint16 // Highest address a byte fits at
+	}{
+		{1, 0},
+		{0x100, 0xff},
+		{0x10000, 0xffff},
+	} {
+		r := NewRAM(tc.size)
+		if r.Size() != tc.size {
+			t.Errorf("NewRAM(%#x) has %#x bytes", tc.size, r.Size())
+		}
+		if err := r.Save8(tc.last, 0, 0xab); err != nil {
+			t.Errorf("%#x bytes: last byte: %v", tc.size, err)
+		}
+		if b, err := r.Load8(0, tc.last); err != nil || b != 0xab {
+			t.Errorf("%#x bytes: last byte by offset read %#x, %v", tc.size, b, err)
+		}
+		// A word straddling the end doesn't wrap to 0
+		if err := r.Save16(tc.last, 0, 0x1234); codeOf(err) != FaultMemory {
+			t.Errorf("%#x bytes: word at the last byte gave %v", tc.size, err)
+		}
+		if _, err := r.Load16(tc.last-1, 1); codeOf(err) != FaultMemory {
+			t.Errorf("%#x bytes: word read split over addr and offset gave %v", tc.size, err)
+		}
+		if tc.size < 0x10000 {
+			if _, err := r.Load8(tc.last, 1); codeOf(err) != FaultMemory {
+				t.Errorf("%#x bytes: byte past the end gave %v", tc.size, err)
+			}
+		} else if _, err := r.Load8(0xffff, 1); codeOf(err) != FaultMemory {
+			t.Errorf("offset past 64K gave %v", err)
+		}
+		if tc.size > 1 {
+			if err := r.Save16(tc.last-1, 0, 0xbeef); err != nil {
+				t.Errorf("%#x bytes: last word: %v", tc.size, err)
+			}
+			if w, err := r.Load16(tc.last-1, 0); err != nil || w != 0xbeef {
+				t.Errorf("%#x bytes: last word read %#x, %v", tc.size, w, err)
+			}
+		}
+	}
+
+	empty := NewRAM(0)
+	if _, err := empty.Load8(0, 0); codeOf(err) != FaultMemory {
+		t.Errorf("empty RAM read gave %v", err)
+	}
+	defer func() {
+		if recover() == nil {
+			t.Error("RAM bigger than the address space made")
+		}
+	}()
+	NewRAM(0x10001)
+}
@@ -0,0 +1,80 @@
+package emu
+
+// RegisterWindow wraps a Memory, mapping the register file over the 32
+// bytes from a base address so a debugger can read and poke registers with
+// ordinary loads and stores. Register n is the big endian word at base +
+// 2n, the IP included; the memory underneath the window is hidden.
+// Accesses that straddle the edge of the window are split between the two.
+//
+// Guest code sees the window too. Nothing is locked, so a host should only
+// use it from the processor's goroutine, in a hook say, or while the
+// processor isn't running.
+type RegisterWindow struct {
+	inner Memory
+	p     *Processor
+	base  uint16
+}
+
+// NewRegisterWindow maps p's registers into m at base. Install it as
+// p.Memory to make the window visible to the program.
+func NewRegisterWindow(m Memory, p *Processor, base uint16) *RegisterWindow {
+	return &RegisterWindow{m, p, base}
+}
+
+// reg finds the register byte at addr, if addr is in the window
+func (w *RegisterWindow) reg(addr uint16) (*uint8, bool) {
+	i := addr - w.base
+	if i >= 2*uint16(len(w.p.Register)) {
+		return nil, false
+	}
+	r := &w.p.Register[i/2]
+	if i%2 == 0 {
+		return &r.High, true
+	}
+	return &r.Low, true
+}
+
+// Load8 return a byte
+func (w *RegisterWindow) Load8(addr, offset uint16) (uint8, error) {
+	if b, ok := w.reg(addr + offset); ok {
+		return *b, nil
+	}
+	return w.inner.Load8(addr, offset)
+}
+
+// Load16 returns 2 bytes
+func (w *RegisterWindow) Load16(addr, offset uint16) (uint16, error) {
+	_, hi := w.reg(addr + offset)
+	_, lo := w.reg(addr + offset + 1)
+	if !hi && !lo {
+		return w.inner.Load16(addr, offset)
+	}
+	high, err := w.Load8(addr, offset)
+	if err != nil {
+		return 0, err
+	}
+	low, err := w.Load8(addr, offset+1)
+	return uint16(high)<<8 | uint16(low), err
+}
+
+// Save8 stores a byte
+func (w *RegisterWindow) Save8(addr, offset uint16, data uint8) error {
+	if b, ok := w.reg(addr + offset); ok {
+		*b = data
+		return nil
+	}
+	return w.inner.Save8(addr, offset, data)
+}
+
+// Save16 stores 2 bytes
+func (w *RegisterWindow) Save16(addr, offset, data uint16) error {
+	_, hi := w.reg(addr + offset)
+	_, lo := w.reg(addr + offset + 1)
+	if !hi && !lo {
+		return w.inner.Save16(addr, offset, data)
+	}
+	if err := w.Save8(addr, offset, uint8(data>>8)); err != nil {
+		return err
+	}
+	return w.Save8(addr, offset+1, uint8(data))
+}
@@ -0,0 +1,58 @@
+package emu
+
+import "testing"
+
+func TestRegisterWindow(t *testing.T) {
+	p := newTestProcessor(t, `
+		set r1, 0xff00 ; The window
+		set r4, 0xff01 ; Low byte of r0
+		load r2, r4, 8
+		set r3, 0x5678
+		store r3, r1   ; Into r0
+	`)
+	ram := p.Memory
+	ram.Save16(0xff10, 0, 0xdead) // Hidden under r8
+	ram.Save8(0xfeff, 0, 0x11)    // Just below the window
+	w := NewRegisterWindow(ram, p, 0xff00)
+	p.Memory = w
+
+	// Host write, then read back both ways
+	if err := w.Save16(0xff00, 8*2, 0x1234); err != nil {
+		t.Fatal(err)
+	}
+	if r8 := p.Register[8].Get16(); r8 != 0x1234 {
+		t.Errorf("writing the window put %#04x in r8", r8)
+	}
+	if got, err := w.Load16(0xff10, 0); err != nil || got != 0x1234 {
+		t.Errorf("reading r8 back gave %#04x, %v", got, err)
+	}
+	if got, _ := ram.Load16(0xff10, 0); got != 0xdead {
+		t.Errorf("memory under the window changed to %#04x", got)
+	}
+	p.Register[IP].Put16(0)
+	if got, _ := w.Load16(0xff1e, 0); got != 0 {
+		t.Errorf("IP reads as %#04x, want 0", got)
+	}
+
+	// A word across the bottom edge is half memory, half r0
+	p.Register[0].Put16(0xab00)
+	if got, err := w.Load16(0xfeff, 0); err != nil || got != 0x11ab {
+		t.Errorf("word across the edge read %#04x, %v, want 0x11ab", got, err)
+	}
+	if err := w.Save16(0xfeff, 0, 0x2233); err != nil {
+		t.Fatal(err)
+	}
+	if b, _ := ram.Load8(0xfeff, 0); b != 0x22 || p.Register[0].High != 0x33 {
+		t.Errorf("word across the edge wrote %#02x below and %#02x into r0", b, p.Register[0].High)
+	}
+
+	// And the guest sees it through the same Memory
+	p.Register[0].Put16(0x00cd)
+	steps(t, p, 5)
+	if r2 := p.Register[2].Get16(); r2 != 0xcd {
+		t.Errorf("guest byte load of r0 gave %#x", r2)
+	}
+	if r0 := p.Register[0].Get16(); r0 != 0x5678 {
+		t.Errorf("guest store left r0 %#04x, want 0x5678", r0)
+	}
+}
@@ -0,0 +1,81 @@
+package emu
+
+import (
+	"fmt"
+	"math/rand"
+)
+
+// BitFlip is one fault injected by a Scrubber
+type BitFlip struct {
+	Addr uint16
+	Bit  uint8  // 0 is the least significant
+	Step uint64 // Which Step made it, counting from 1
+}
+
+func (f BitFlip) String() string {
+	return fmt.Sprintf("%04x.%d @%d", f.Addr, f.Bit, f.Step)
+}
+
+// Scrubber injects faults by flipping a random bit in a random byte of
+// memory every so often, to simulate corruption. Its choices come from a
+// seeded RNG, so the same seed gives the same faults. Step it from
+// AfterExec (see Hook) to tie the rate to instructions, which keeps runs
+// reproducible; stepping it from anywhere else races with the processor.
+type Scrubber struct {
+	mem    Memory
+	rng    *rand.Rand
+	start  uint16
+	size   uint32
+	every  uint64
+	steps  uint64
+	faults []BitFlip
+}
+
+// NewScrubber makes a Scrubber for size bytes of m from start, flipping a
+// bit on every every'th Step
+func NewScrubber(m Memory, seed int64, start uint16, size uint32, every uint64) *Scrubber {
+	if every == 0 {
+		every = 1
+	}
+	return &Scrubber{
+		mem:   m,
+		rng:   rand.New(rand.NewSource(seed)),
+		start: start,
+		size:  size,
+		every: every,
+	}
+}
+
+// Step counts one unit of time and flips a bit when one is due
+func (s *Scrubber) Step() error {
+	if s.steps++; s.steps%s.every != 0 || s.size == 0 {
+		return nil
+	}
+	f := BitFlip{
+		Addr: s.start + uint16(s.rng.Int63n(int64(s.size))),
+		Bit:  uint8(s.rng.Intn(8)),
+		Step: s.steps,
+	}
+	data, err := s.mem.Load8(f.Addr, 0)
+	if err != nil {
+		return err
+	}
+	if err = s.mem.Save8(f.Addr, 0, data^1<<f.Bit); err != nil {
+		return err
+	}
+	s.faults = append(s.faults, f)
+	return nil
+}
+
+// Hook returns a Hook that steps the scrubber, for AfterExec. Errors from
+// the memory are dropped; those faults just don't happen.
+func (s *Scrubber) Hook() Hook {
+	return func(ip uint16, opcode uint8, args [3]uint8) {
+		s.Step()
+	}
+}
+
+// Faults lists every bit flipped so far, oldest first
+func (s *Scrubber) Faults() []BitFlip {
+	return s.faults
+}
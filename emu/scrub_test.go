@@ -0,0 +1,45 @@
+package emu
+
+import (
+	"slices"
+	"testing"
+)
+
+func TestScrubberSeed(t *testing.T) {
+	run := func(seed int64) ([]BitFlip, *RAM) {
+		ram := NewRAM(0x100)
+		s := NewScrubber(ram, seed, 0x40, 0x80, 3)
+		for range 30 {
+			if err := s.Step(); err != nil {
+				t.Fatal(err)
+			}
+		}
+		return s.Faults(), ram
+	}
+	first, ram1 := run(7)
+	again, ram2 := run(7)
+	if len(first) != 10 {
+		t.Fatalf("%d faults in 30 steps, want 10: %v", len(first), first)
+	}
+	if !slices.Equal(first, again) {
+		t.Errorf("seed 7 gave %v, then %v", first, again)
+	}
+	for i, f := range first {
+		if f.Step != uint64(3*(i+1)) {
+			t.Errorf("fault %d made at step %d, want %d", i, f.Step, 3*(i+1))
+		}
+		if f.Addr < 0x40 || f.Addr >= 0xc0 || f.Bit > 7 {
+			t.Errorf("fault %d at %v is outside the scrubbed range", i, f)
+		}
+	}
+	for addr := uint16(0); addr < 0x100; addr++ {
+		a, _ := ram1.Load8(addr, 0)
+		b, _ := ram2.Load8(addr, 0)
+		if a != b {
+			t.Errorf("byte %x is %x, then %x", addr, a, b)
+		}
+	}
+	if other, _ := run(8); slices.Equal(first, other) {
+		t.Errorf("seeds 7 and 8 both gave %v", first)
+	}
+}
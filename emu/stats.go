@@ -0,0 +1,55 @@
+package emu
+
+import "time"
+
+// RunStats summarizes what the processor did during its last Run
+type RunStats struct {
+	Instructions uint64     // Instructions executed, faulting ones included
+	Opcodes      [16]uint64 // Executions by opcode, extended ones count under NOT
+	Extended     [16]uint64 // Executions by extended instruction, escaped ones count under ESC
+	Escaped      [16]uint64 // Executions by escaped instruction
+	BusSends     uint64     // Successful SBUS sends, broadcasts included
+	BusRecvs     uint64     // Successful RBUS reads
+	Interrupts   uint64     // Interrupt handlers entered
+	MemReads     uint64     // Memory loads, each instruction fetch byte included
+	MemWrites    uint64     // Memory stores
+	Elapsed      time.Duration
+}
+
+// Stats returns the counters from the last Run. Call it after Run returns;
+// reading them while it runs races with the processor.
+func (p *Processor) Stats() RunStats {
+	return p.stats
+}
+
+// countingMemory is the processor's Memory as its instructions see it,
+// tallying their accesses into the RunStats. p.Memory itself is left alone,
+// so the optional interfaces it has are still there to find.
+type countingMemory struct {
+	p *Processor
+}
+
+// mem is the Memory that fetch and the instructions go through
+func (p *Processor) mem() Memory {
+	return countingMemory{p}
+}
+
+func (m countingMemory) Load8(addr, offset uint16) (uint8, error) {
+	m.p.stats.MemReads++
+	return m.p.Memory.Load8(addr, offset)
+}
+
+func (m countingMemory) Load16(addr, offset uint16) (uint16, error) {
+	m.p.stats.MemReads++
+	return m.p.Memory.Load16(addr, offset)
+}
+
+func (m countingMemory) Save8(addr, offset uint16, data uint8) error {
+	m.p.stats.MemWrites++
+	return m.p.Memory.Save8(addr, offset, data)
+}
+
+func (m countingMemory) Save16(addr, offset, data uint16) error {
+	m.p.stats.MemWrites++
+	return m.p.Memory.Save16(addr, offset, data)
+}
@@ -0,0 +1,48 @@
+package emu
+
+import (
+	"testing"
+	"time"
+)
+
+func TestRunStats(t *testing.T) {
+	code, err := Assemble(`
+		set r1, 0x0102 ; 3 reads: the word and the immediate
+		set r2, 0xbeef
+		sbus r1        ; 1 read
+		rbus r1        ; 1 read
+		set r3, 0x2000
+		store r2, r3   ; 2 reads and a write
+		load r4, r3    ; 3 reads
+		halt           ; 3 reads: the word and the selector
+	`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p := NewProcessor(NewRAM(0x10000), NewBootmedia(code, 0, 0), &wordBus{}, nil)
+	if err := p.Boot(); err != nil {
+		t.Fatal(err)
+	}
+	tick := make(chan time.Time)
+	close(tick) // Free running
+	p.Ticker = tick
+	p.Run(make(chan error))
+
+	want := RunStats{Instructions: 8, BusSends: 1, BusRecvs: 1, MemReads: 19, MemWrites: 1}
+	want.Opcodes[SET] = 3
+	want.Opcodes[SBUS] = 1
+	want.Opcodes[RBUS] = 1
+	want.Opcodes[STORE] = 1
+	want.Opcodes[LOAD] = 1
+	want.Opcodes[NOT] = 1
+	want.Extended[ESC] = 1
+	want.Escaped[HALT] = 1
+	got := p.Stats()
+	if got.Elapsed <= 0 {
+		t.Errorf("Elapsed is %v, want more than 0", got.Elapsed)
+	}
+	got.Elapsed = 0
+	if got != want {
+		t.Errorf("stats\n%+v\nwant\n%+v", got, want)
+	}
+}
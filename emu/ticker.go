@@ -0,0 +1,67 @@
+package emu
+
+import "time"
+
+// ManualTicker lets tests and debuggers decide when the processor moves on,
+// instead of a time.Ticker. Pass C to NewProcessor as the ticker.
+//
+// Run executes an instruction and then waits for a tick, so the first
+// instruction runs without one. Tick blocks until Run has taken the tick,
+// which means every instruction before it has finished executing.
+type ManualTicker struct {
+	C chan time.Time
+}
+
+// NewManualTicker makes a ticker that only ticks when told to
+func NewManualTicker() *ManualTicker {
+	return &ManualTicker{C: make(chan time.Time)}
+}
+
+// Tick releases the processor to execute one more instruction
+func (t *ManualTicker) Tick() {
+	t.C <- time.Time{}
+}
+
+// Clock is a ticker run on simulated time rather than the wall clock. Time
+// only passes when Advance says so, ticking once per period along the way,
+// so a test can run a program for exactly so many ticks, or a simulation
+// can be stepped forward by amounts of real time. Pass C to NewProcessor as
+// the ticker.
+//
+// Advance and Now are for the goroutine driving the clock; they aren't
+// safe to call from several at once.
+type Clock struct {
+	C      chan time.Time
+	now    time.Time
+	next   time.Time // When the next tick is due
+	period time.Duration
+}
+
+// NewClock makes a clock reading start that ticks every period
+func NewClock(start time.Time, period time.Duration) *Clock {
+	if period <= 0 {
+		panic("Clock period must be positive")
+	}
+	return &Clock{C: make(chan time.Time), now: start, next: start.Add(period), period: period}
+}
+
+// Advance moves the clock on by d, sending a tick, stamped with the time it
+// was due, for each period that ends along the way. Like Tick it blocks
+// until Run has taken each one.
+func (c *Clock) Advance(d time.Duration) {
+	if d < 0 {
+		panic("Clock can't go backwards")
+	}
+	end := c.now.Add(d)
+	for !c.next.After(end) {
+		c.now = c.next
+		c.C <- c.next
+		c.next = c.next.Add(c.period)
+	}
+	c.now = end
+}
+
+// Now is the clock's current time
+func (c *Clock) Now() time.Time {
+	return c.now
+}
@@ -0,0 +1,70 @@
+package emu
+
+import (
+	"testing"
+	"time"
+)
+
+func TestManualTicker(t *testing.T) {
+	p := newTestProcessor(t, `
+		setb r1, 1
+		set r3, loop
+	loop:
+		add r2, r2, r1
+		jmp r3
+	`)
+	tick, ints := NewManualTicker(), make(chan Interrupt)
+	p.Ticker, p.Ints = tick.C, ints
+	done := make(chan struct{})
+	go func() {
+		p.Run(make(chan error))
+		close(done)
+	}()
+	for range 7 {
+		tick.Tick()
+	}
+	close(ints) // Run is waiting for the eighth tick, so it stops there
+	<-done
+	// The first instruction runs without a tick, so eight have run: the
+	// setup and three times round the loop
+	if st := p.Stats(); st.Instructions != 8 {
+		t.Errorf("%d instructions ran, want 8", st.Instructions)
+	}
+	if r2, ip := p.Register[2].Get16(), p.Register[IP].Get16(); r2 != 3 || ip != 6 {
+		t.Errorf("r2 %d IP %d, want 3 and 6", r2, ip)
+	}
+}
+
+func TestClock(t *testing.T) {
+	p := newTestProcessor(t, `
+		setb r1, 1
+		set r3, loop
+	loop:
+		add r2, r2, r1
+		jmp r3
+	`)
+	start := time.Date(2000, 1, 1, 0, 0, 0, 0, time.UTC)
+	clock, ints := NewClock(start, 10*time.Millisecond), make(chan Interrupt)
+	p.Ticker, p.Ints = clock.C, ints
+	done := make(chan struct{})
+	go func() {
+		p.Run(make(chan error))
+		close(done)
+	}()
+	clock.Advance(35 * time.Millisecond) // Ticks at 10, 20 and 30
+	if now := clock.Now(); !now.Equal(start.Add(35 * time.Millisecond)) {
+		t.Errorf("clock reads %v after 35ms", now.Sub(start))
+	}
+	clock.Advance(5 * time.Millisecond) // And 40
+	clock.Advance(9 * time.Millisecond) // Not yet 50
+	close(ints)
+	<-done
+	// Four ticks and the first instruction, which runs without one, make
+	// five: the setup, then add, jmp, add
+	if st := p.Stats(); st.Instructions != 5 {
+		t.Errorf("%d instructions ran, want 5", st.Instructions)
+	}
+	if r2 := p.Register[2].Get16(); r2 != 2 {
+		t.Errorf("r2 is %d, want 2", r2)
+	}
+}
@@ -0,0 +1,101 @@
+package emu
+
+import (
+	"fmt"
+	"io"
+	"log/slog"
+	"time"
+)
+
+// RegisterFormat changes how WriteRegisters shows values. The zero value
+// gives plain unsigned hex.
+type RegisterFormat struct {
+	Signed bool // Also show each register as a signed decimal
+	Radix  int  // 2, 10 or 16 for register values; anything else is 16
+}
+
+// value renders a register value in the format's radix
+func (f RegisterFormat) value(v uint16) string {
+	switch f.Radix {
+	case 2:
+		return fmt.Sprintf("0b%016b", v)
+	case 10:
+		return fmt.Sprintf("%5d", v)
+	}
+	return fmt.Sprintf("0x%04x", v)
+}
+
+// WriteRegisters renders the IP, flags and register file as a table
+func (p *Processor) WriteRegisters(w io.Writer, opts ...RegisterFormat) {
+	var f RegisterFormat
+	if len(opts) > 0 {
+		f = opts[0]
+	}
+	fmt.Fprintf(w, "IP: %04x  Flags: %04x\n", p.Register[IP].Get16(), p.Flags)
+	fmt.Fprintf(w, "==========\n")
+	for i := range p.Register {
+		v := p.Register[i].Get16()
+		if f.Signed {
+			fmt.Fprintf(w, "0x%x %s %6d\n", i, f.value(v), int16(v))
+		} else {
+			fmt.Fprintf(w, "0x%x %s\n", i, f.value(v))
+		}
+	}
+}
+
+// drawRegisters redraws the register table in place for verbose mode
+func (p *Processor) drawRegisters() {
+	fmt.Fprint(p.Verbose, "\033[5;1H")
+	p.WriteRegisters(p.Verbose, p.VerboseFormat)
+}
+
+// CallKind tells the events in a call trace apart
+type CallKind int
+
+// Call trace event kinds
+const (
+	EnterCall      CallKind = iota // CALL entered a subroutine
+	ExitCall                       // RET left one
+	EnterInterrupt                 // An interrupt entered its handler
+	ExitInterrupt                  // IRET left the handler
+)
+
+// CallEvent is one entry in the call trace, see Processor.OnCall
+type CallEvent struct {
+	Kind  CallKind
+	From  uint16 // Address of the call, ret or iret, or the IP an interrupt stopped
+	To    uint16 // Where execution carries on
+	Bus   uint8  // Interrupting bus, for EnterInterrupt events
+	Count uint64 // Instructions executed so far this Run, for timing
+}
+
+// call reports a control transfer to OnCall
+func (p *Processor) call(kind CallKind, from, to uint16, bus uint8) {
+	if p.OnCall != nil {
+		p.OnCall(CallEvent{kind, from, to, bus, p.stats.Instructions})
+	}
+}
+
+// BusBlock reports a bus transfer that has outlasted Processor.BusTimeout
+type BusBlock struct {
+	IP     uint16 // Address of the blocked instruction
+	Opcode uint8  // SBUS or RBUS
+	Bus    uint8
+}
+
+// watchBus starts the BusTimeout clock on a transfer. Call the returned
+// func once the transfer is done.
+func (p *Processor) watchBus(opcode, bus uint8) (stop func()) {
+	if p.BusTimeout <= 0 {
+		return func() {}
+	}
+	b := BusBlock{p.Register[IP].Get16(), opcode, bus}
+	after, report := p.BusTimeout, p.OnBusBlocked
+	t := time.AfterFunc(after, func() {
+		p.log(slog.LevelWarn, "Blocked on bus", "ip", b.IP, "opcode", b.Opcode, "bus", b.Bus, "after", after)
+		if report != nil {
+			report(b)
+		}
+	})
+	return func() { t.Stop() }
+}
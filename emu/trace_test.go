@@ -0,0 +1,178 @@
+package emu
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestCallTrace(t *testing.T) {
+	p := newTestProcessor(t, `
+		set sp, 0x100
+		set r1, a
+		call r1 ; At 6
+		set r1, 0x7777
+	end:
+		set r2, end
+		jmp r2
+	a:
+		set r3, b ; At 0x10
+		call r3
+		ret
+	b:
+		ret ; At 0x17
+	handler:
+		iret ; At 0x19
+	`)
+	var events []string
+	p.OnCall = func(e CallEvent) {
+		events = append(events, fmt.Sprintf("%d %x>%x", e.Kind, e.From, e.To))
+	}
+	steps(t, p, 7) // Into a, into b and back out to set r1
+	if err := p.Interrupt(Interrupt{BusAddr: 2, Handler: 0x19}); err != nil {
+		t.Fatal(err)
+	}
+	steps(t, p, 1)
+	want := []string{
+		fmt.Sprintf("%d 6>10", EnterCall),
+		fmt.Sprintf("%d 13>17", EnterCall),
+		fmt.Sprintf("%d 17>15", ExitCall),
+		fmt.Sprintf("%d 15>8", ExitCall),
+		fmt.Sprintf("%d 8>19", EnterInterrupt),
+		fmt.Sprintf("%d 19>8", ExitInterrupt),
+	}
+	if got := strings.Join(events, ", "); got != strings.Join(want, ", ") {
+		t.Errorf("got  %s\nwant %s", got, strings.Join(want, ", "))
+	}
+}
+
+func TestWriteRegistersSigned(t *testing.T) {
+	p := newTestProcessor(t, "nop")
+	p.Register[3].Put16(0xffff)
+	p.Register[4].Put16(0x8000)
+	var b strings.Builder
+	p.WriteRegisters(&b, RegisterFormat{Signed: true})
+	for _, line := range []string{"0x3 0xffff     -1\n", "0x4 0x8000 -32768\n", "0x5 0x0000      0\n"} {
+		if !strings.Contains(b.String(), line) {
+			t.Errorf("no %q in\n%s", line, b.String())
+		}
+	}
+	b.Reset()
+	p.WriteRegisters(&b)
+	if !strings.Contains(b.String(), "0x3 0xffff\n") {
+		t.Errorf("unsigned dump\n%s\nshould end the line after the hex", b.String())
+	}
+}
+
+func TestWriteRegistersRadix(t *testing.T) {
+	p := newTestProcessor(t, "nop")
+	p.Register[3].Put16(0x00a5)
+	for _, tc := range []struct {
+		radix int
+		line  string
+	}{
+		{0, "0x3 0x00a5\n"},
+		{16, "0x3 0x00a5\n"},
+		{10, "0x3   165\n"},
+		{2, "0x3 0b0000000010100101\n"},
+		{8, "0x3 0x00a5\n"}, // Unsupported, so hex
+	} {
+		var b strings.Builder
+		p.WriteRegisters(&b, RegisterFormat{Radix: tc.radix})
+		if !strings.Contains(b.String(), tc.line) {
+			t.Errorf("radix %d: no %q in\n%s", tc.radix, tc.line, b.String())
+		}
+	}
+	var b strings.Builder
+	p.WriteRegisters(&b, RegisterFormat{Radix: 10, Signed: true})
+	if !strings.Contains(b.String(), "0x3   165    165\n") {
+		t.Errorf("decimal and signed\n%s", b.String())
+	}
+}
+
+func TestVerboseRegisters(t *testing.T) {
+	p := newTestProcessor(t, "setb r1, 5\nsub r2, r0, r1\nhalt")
+	var b strings.Builder
+	p.Verbose, p.VerboseFormat = &b, RegisterFormat{Signed: true}
+	tick := make(chan time.Time)
+	close(tick) // Free running
+	p.Ticker = tick
+	p.Run(make(chan error))
+
+	// Redrawn in place after each of the three instructions, so the last
+	// table is the one left on screen
+	const last = "\033[5;1H" + `IP: 0008  Flags: 0006
+==========
+0x0 0x0000      0
+0x1 0x0005      5
+0x2 0xfffb     -5
+0x3 0x0000      0
+0x4 0x0000      0
+0x5 0x0000      0
+0x6 0x0000      0
+0x7 0x0000      0
+0x8 0x0000      0
+0x9 0x0000      0
+0xa 0x0000      0
+0xb 0x0000      0
+0xc 0x0000      0
+0xd 0x0000      0
+0xe 0x0000      0
+0xf 0x0008      8
+`
+	got := b.String()
+	if n := strings.Count(got, "\033[5;1H"); n != 3 {
+		t.Errorf("drew the table %d times, want 3", n)
+	}
+	if !strings.HasSuffix(got, last) {
+		t.Errorf("verbose output ended\n%s\nwant\n%s", got[max(len(got)-len(last), 0):], last)
+	}
+}
+
+func TestBusBlocked(t *testing.T) {
+	code, err := Assemble("set r1, 0x0002 ; bus 0 into r2\nrbus r1\nrbus r1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	b := NewBus(0)
+	b.Add()
+	p := NewProcessor(NewRAM(0x100), NewBootmedia(code, 0, 0), b, nil)
+	if err := p.Boot(); err != nil {
+		t.Fatal(err)
+	}
+	blocked := make(chan BusBlock, 2)
+	p.BusTimeout = 20 * time.Millisecond
+	p.OnBusBlocked = func(bb BusBlock) { blocked <- bb }
+	steps(t, &p, 1)
+
+	done := make(chan error)
+	go func() { done <- p.execute() }()
+	select {
+	case bb := <-blocked:
+		if bb != (BusBlock{IP: 3, Opcode: RBUS, Bus: 0}) {
+			t.Errorf("reported %+v, want RBUS on bus 0 at 3", bb)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("idle RBUS never reported")
+	}
+	b.Input(0) <- 0x42 // Still waiting, so it gets the word
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+	if r2 := p.Register[2].Get16(); r2 != 0x42 {
+		t.Errorf("r2 is %#x after the late word, want 0x42", r2)
+	}
+
+	// One answered straight away isn't reported
+	go func() { done <- p.execute() }()
+	b.Input(0) <- 0x43
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case bb := <-blocked:
+		t.Errorf("reported %+v for a prompt word", bb)
+	case <-time.After(2 * p.BusTimeout):
+	}
+}
@@ -0,0 +1,135 @@
+package emu
+
+// Validate checks the booted image without running it, walking it the same
+// way Instructions does. It reports instructions that run off the end of
+// the image, registers the program may not touch, and jumps that land
+// inside an instruction. A jump target is only known when the register was
+// loaded by set or setb, not under pred, earlier in straight line code;
+// anything else, and targets outside the walk, are given the benefit of
+// the doubt. Call it before Run.
+func (p *Processor) Validate() []error {
+	var errs []error
+	var code []InstrInfo
+	starts := map[uint16]bool{}
+	for in := range p.Instructions() {
+		code = append(code, in)
+		starts[in.Addr] = true
+	}
+	if len(code) == 0 {
+		return nil
+	}
+	first := uint32(code[0].Addr)
+	last := code[len(code)-1]
+	end := uint32(last.Addr) + uint32(last.Width)
+
+	known := map[uint8]uint16{} // Registers holding a constant
+	predicated := false         // The previous instruction was PRED
+	for _, in := range code {
+		if uint32(in.Addr)+uint32(in.Width) > uint32(p.codeEnd) {
+			errs = append(errs, ProcError{"Instruction runs past the end of the image", FaultInstruction, in.Addr, 0, nil, nil})
+		}
+		for _, r := range regOperands(in) {
+			if !p.usable(r) {
+				errs = append(errs, ProcError{"Register out of range", FaultRegister, in.Addr, 0, []uint8{r}, nil})
+			}
+		}
+
+		target, jumps := uint8(0), false
+		switch {
+		case in.Opcode == LJUMP || in.Opcode == EJUMP:
+			target, jumps = in.Args[2], true
+		case in.Ext == CALL:
+			target, jumps = in.Args[0], true
+		}
+		if v, ok := known[target]; jumps && ok && uint32(v) >= first && uint32(v) < end && !starts[v] {
+			errs = append(errs, ProcError{"Jump into the middle of an instruction", FaultInstruction, in.Addr, 0, []uint8{uint8(v >> 8), uint8(v)}, nil})
+		}
+
+		maybe := predicated
+		predicated = in.Ext == ESC && in.Esc == PRED
+		switch {
+		case maybe && (in.Opcode == SET || in.Ext == SETB):
+			delete(known, in.Args[0]) // May not run
+		case in.Opcode == SET:
+			known[in.Args[0]] = in.Imm
+		case in.Ext == SETB:
+			known[in.Args[0]] = in.Imm >> 8
+		default:
+			regs, all := regWrites(in)
+			if all {
+				known = map[uint8]uint16{}
+			}
+			for _, r := range regs {
+				delete(known, r)
+			}
+		}
+	}
+	return errs
+}
+
+// regOperands lists the registers named in an instruction word, and the
+// third register of an escaped instruction. Other operands in an extended
+// instruction's trailing byte aren't included.
+func regOperands(in InstrInfo) []uint8 {
+	var regs []uint8
+	if in.Ext == 0 {
+		for i, r := range in.Args {
+			if regArgs[in.Opcode][i] {
+				regs = append(regs, r)
+			}
+		}
+		return regs
+	}
+	if in.Ext == ESC {
+		n := 3
+		if x, ok := escMnemonics[escNames[in.Esc]]; ok {
+			n = min(int(x.regs), 3) // PRED's are flag constants
+		}
+		return []uint8{in.Args[0], in.Args[1], in.Arg3}[:n]
+	}
+	for _, x := range extMnemonics {
+		if x.op != in.Ext {
+			continue
+		}
+		n := min(int(x.regs), 2)
+		regs = append(regs, in.Args[:n]...)
+	}
+	return regs
+}
+
+// regWrites lists the registers an instruction changes. all means it may
+// change registers that can't be told from the instruction alone.
+func regWrites(in InstrInfo) (regs []uint8, all bool) {
+	switch in.Ext {
+	case 0:
+	case SMUL:
+		return in.Args[:2], false
+	case SETB, GETF, POP, RLOAD:
+		return in.Args[:1], false
+	case ESC:
+		switch in.Esc {
+		case MUL:
+			return in.Args[:2], false
+		case PRED, SBUSB, HALT:
+			return nil, false
+		case RBUSB:
+			return nil, true // Data register is indirect
+		}
+		return in.Args[:1], false
+	case PEEK:
+		return in.Args[1:2], true // Data register is indirect
+	case CALL:
+		return nil, true // The callee may change anything
+	case RSTORE:
+		return nil, true // Destination is indirect
+	default:
+		return nil, false
+	}
+	switch in.Opcode {
+	case WBUS, RBUS:
+		return nil, true // Data register is indirect
+	case STORE, SBUS, LJUMP, EJUMP:
+		return nil, false
+	}
+	return in.Args[:1], false
+}
@@ -0,0 +1,29 @@
+package emu
+
+import "testing"
+
+func TestValidate(t *testing.T) {
+	for _, tc := range []struct {
+		name, src string
+		errs      int
+	}{
+		{"clean loop", "set r1, 0\nloop: set r2, loop\nadd r1, r1, r1\nljump r1, r3, r2\njmp r2", 0},
+		{"jump into the nop", "set r2, 4\nnop\njmp r2", 1},
+		{"target unknown after add", "set r2, 4\nadd r2, r2, r2\njmp r2", 0},
+		{"setb target", "setb r2, 4\nnop\njmp r2", 1},
+	} {
+		p := newTestProcessor(t, tc.src)
+		if errs := p.Validate(); len(errs) != tc.errs {
+			t.Errorf("%s: got %v, want %d errors", tc.name, errs, tc.errs)
+		}
+	}
+
+	// A set whose immediate is cut off by the end of the image
+	p := NewProcessor(NewRAM(0x100), NewBootmedia([]uint8{0x21, 0x00}, 0, 0), &testBus{}, nil)
+	if err := p.Boot(); err != nil {
+		t.Fatal(err)
+	}
+	if errs := p.Validate(); len(errs) != 1 {
+		t.Errorf("truncated set: got %v, want 1 error", errs)
+	}
+}
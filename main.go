@@ -1,11 +1,18 @@
 package main
 
 import (
-	"encoding/hex"
+	"bufio"
+	"encoding/binary"
 	"errors"
+	"flag"
 	"fmt"
+	"io"
 	"io/ioutil"
+	"maps"
 	"os"
+	"slices"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/jensenak/emu16/emu"
@@ -17,213 +24,669 @@ import (
 
 // Mem is system memory
 type Mem struct {
-	bank     []uint8
+	bank     []uint8 // The selected bank
 	bankSize uint16
+	banks    [][]uint8
+	active   int
+	Log      func(emu.Access) // Optional, called on every load and store
+
+	// RegionSize turns on access counting: loads and stores are tallied
+	// into buckets of this many bytes, see Regions. 0 counts nothing.
+	RegionSize uint16
+	regions    map[uint16]uint64
+
+	// CheckUninit makes loads fail when they touch a byte nothing has saved
+	// to since the banks were made, to catch reads of uninitialized memory.
+	// Boot saves the image, so the program itself counts as written.
+	CheckUninit bool
+	written     [][]uint64 // Per bank, a bit for each byte saved to
 }
 
-func (m *Mem) newBanks(length uint16) {
-	m.bank = make([]uint8, length)
+// note logs and counts an access: a load once it has read the data, a
+// store as it's about to write it
+func (m *Mem) note(a emu.Access) {
+	if m.Log != nil {
+		m.Log(a)
+	}
+	if m.RegionSize > 0 {
+		if m.regions == nil {
+			m.regions = map[uint16]uint64{}
+		}
+		m.regions[a.Addr-a.Addr%m.RegionSize]++
+	}
+}
+
+// Regions returns the access counts by the address each bucket starts at.
+// Buckets never touched are left out. An access is counted in the bucket
+// its first byte is in.
+func (m *Mem) Regions() map[uint16]uint64 {
+	out := make(map[uint16]uint64, len(m.regions))
+	for addr, n := range m.regions {
+		out[addr] = n
+	}
+	return out
+}
+
+func (m *Mem) newBanks(count int, length uint16) {
+	m.banks = make([][]uint8, count)
+	m.written = make([][]uint64, count)
+	for i := range m.banks {
+		m.banks[i] = make([]uint8, length)
+		m.written[i] = make([]uint64, (int(length)+63)/64)
+	}
+	m.bank = m.banks[0]
 	m.bankSize = length
+	m.active = 0
+}
+
+// Banks returns how many banks there are
+func (m *Mem) Banks() int {
+	return len(m.banks)
+}
+
+// BankSize returns the size of each bank
+func (m *Mem) BankSize() uint16 {
+	return m.bankSize
+}
+
+// Bank returns the selected bank
+func (m *Mem) Bank() int {
+	return m.active
+}
+
+// SelectBank makes a different bank visible to loads and saves
+func (m *Mem) SelectBank(bank int) error {
+	if bank < 0 || bank >= len(m.banks) {
+		return fmt.Errorf("No such bank %d", bank)
+	}
+	m.bank = m.banks[bank]
+	m.active = bank
+	return nil
+}
+
+// outside reports whether width bytes at addr + offset run past the end of
+// the bank. The sum can't wrap back into range.
+func (m *Mem) outside(addr, offset uint16, width uint32) bool {
+	return uint32(addr)+uint32(offset)+width > uint32(m.bankSize)
+}
+
+// mark records that width bytes from a in the selected bank were saved to
+func (m *Mem) mark(a uint16, width uint16) {
+	w := m.written[m.active]
+	for b := a; b < a+width; b++ {
+		w[b/64] |= 1 << (b % 64)
+	}
+}
+
+// uninit finds the first of width bytes from a that was never saved to
+func (m *Mem) uninit(a uint16, width uint16) (uint16, bool) {
+	w := m.written[m.active]
+	for b := a; b < a+width; b++ {
+		if w[b/64]&(1<<(b%64)) == 0 {
+			return b, true
+		}
+	}
+	return 0, false
 }
 
 // Load8 return a byte
 func (m *Mem) Load8(addr, offset uint16) (uint8, error) {
-	if addr+offset > m.bankSize {
+	if m.outside(addr, offset, 1) {
 		return 0, fmt.Errorf("Segfault (accessing 8 %x + offset %x)", addr, offset)
 	}
-	return m.bank[addr+offset], nil
+	if m.CheckUninit {
+		if at, ok := m.uninit(addr+offset, 1); ok {
+			return 0, fmt.Errorf("Uninitialized read of %x (accessing 8 %x + offset %x)", at, addr, offset)
+		}
+	}
+	data := m.bank[addr+offset]
+	m.note(emu.Access{Addr: addr + offset, Width: 1, Data: uint16(data)})
+	return data, nil
 }
 
 // Load16 returns 2 bytes
 func (m *Mem) Load16(addr, offset uint16) (uint16, error) {
-	if addr+offset+1 > m.bankSize {
+	if m.outside(addr, offset, 2) {
 		return 0, fmt.Errorf("Segfault (accessing 16 %x + offset %x)", addr, offset)
 	}
-	return uint16(m.bank[addr+offset])<<8 | uint16(m.bank[addr+offset+1]), nil
+	if m.CheckUninit {
+		if at, ok := m.uninit(addr+offset, 2); ok {
+			return 0, fmt.Errorf("Uninitialized read of %x (accessing 16 %x + offset %x)", at, addr, offset)
+		}
+	}
+	data := uint16(m.bank[addr+offset])<<8 | uint16(m.bank[addr+offset+1])
+	m.note(emu.Access{Addr: addr + offset, Width: 2, Data: data})
+	return data, nil
 }
 
 // Save8 stores a byte
 func (m *Mem) Save8(addr, offset uint16, data uint8) error {
-	if addr+offset > m.bankSize {
+	if m.outside(addr, offset, 1) {
 		return fmt.Errorf("Segfault (saving 8 %x + offset %x)", addr, offset)
 	}
+	m.note(emu.Access{Addr: addr + offset, Width: 1, Write: true, Data: uint16(data)})
+	m.mark(addr+offset, 1)
 	m.bank[addr+offset] = data
 	return nil
 }
 
 // Save16 stores 2 bytes
 func (m *Mem) Save16(addr, offset, data uint16) error {
-	if addr+offset+1 > m.bankSize {
+	if m.outside(addr, offset, 2) {
 		return fmt.Errorf("Segfault (saving 16 %x + offset %x)", addr, offset)
 	}
+	m.note(emu.Access{Addr: addr + offset, Width: 2, Write: true, Data: data})
+	m.mark(addr+offset, 2)
 	m.bank[addr+offset] = uint8(data >> 8)
 	m.bank[addr+offset+1] = uint8(data & 0xFF)
 	return nil
 }
 
+// Quiet returns the selected bank without Log, region counting or the
+// uninitialized read check, for things that aren't the program: the
+// scrubber's bit flips are faults, not accesses.
+func (m *Mem) Quiet() emu.Memory {
+	return quietMem{m}
+}
+
+type quietMem struct {
+	m *Mem
+}
+
+func (q quietMem) Load8(addr, offset uint16) (uint8, error) {
+	if q.m.outside(addr, offset, 1) {
+		return 0, fmt.Errorf("Segfault (accessing 8 %x + offset %x)", addr, offset)
+	}
+	return q.m.bank[addr+offset], nil
+}
+
+func (q quietMem) Load16(addr, offset uint16) (uint16, error) {
+	if q.m.outside(addr, offset, 2) {
+		return 0, fmt.Errorf("Segfault (accessing 16 %x + offset %x)", addr, offset)
+	}
+	return uint16(q.m.bank[addr+offset])<<8 | uint16(q.m.bank[addr+offset+1]), nil
+}
+
+func (q quietMem) Save8(addr, offset uint16, data uint8) error {
+	if q.m.outside(addr, offset, 1) {
+		return fmt.Errorf("Segfault (saving 8 %x + offset %x)", addr, offset)
+	}
+	q.m.bank[addr+offset] = data
+	return nil
+}
+
+func (q quietMem) Save16(addr, offset, data uint16) error {
+	if q.m.outside(addr, offset, 2) {
+		return fmt.Errorf("Segfault (saving 16 %x + offset %x)", addr, offset)
+	}
+	q.m.bank[addr+offset] = uint8(data >> 8)
+	q.m.bank[addr+offset+1] = uint8(data & 0xFF)
+	return nil
+}
+
 //==================================================\\
 // BUS Modules
 //==================================================\\
 
 // Bus is for communication
 type Bus struct {
-	c    chan<- emu.Interrupt
-	ch   []channels
-	wait []uint8
+	c  chan<- emu.Interrupt
+	ch []channels
+
+	mu       sync.RWMutex  // Held for reading while raising, writing to close
+	closed   bool          // c has been closed
+	quit     chan struct{} // Closed first, to unblock raisers before c closes
+	quitOnce sync.Once
 }
 
 type channels struct {
-	out chan uint16 // output <- cpu
-	in  chan uint16 // data -> cpu
+	out       chan uint16 // output <- cpu
+	in        chan uint16 // data -> cpu
+	broadcast bool        // receives Broadcast data
+	held      bool        // head was taken off in by Peek
+	head      uint16
+	recvd     func(data uint16) (stop bool) // Optional, sees each word Recv hands the cpu
 }
 
 func (b *Bus) newBus(buffer int) int {
 	in := make(chan uint16, buffer)
 	out := make(chan uint16, buffer)
-	chans := channels{out, in}
+	chans := channels{out: out, in: in}
 	b.ch = append(b.ch, chans)
 	return len(b.ch) - 1
 }
 
 // Send is to put data on a bus
 func (b *Bus) Send(addr uint8, data uint16) error {
-	if uint8(len(b.ch)) < addr {
+	if int(addr) >= len(b.ch) {
 		return errors.New("Invalid bus address")
 	}
 	b.ch[addr].out <- data
 	return nil
 }
 
-// Recv gets data off a bus
+// Recv gets data off a bus. If the bus's recvd says to stop, the word is
+// kept from the cpu and Recv waits for the bus to close instead.
 func (b *Bus) Recv(addr uint8) (uint16, error) {
-	if uint8(len(b.ch)) < addr {
+	if int(addr) >= len(b.ch) {
 		return 0, errors.New("Invalid bus address")
 	}
-	return <-b.ch[addr].in, nil
+	c := &b.ch[addr]
+	var data uint16
+	if c.held {
+		c.held = false
+		data = c.head
+	} else {
+		data = <-c.in
+	}
+	if c.recvd != nil && c.recvd(data) {
+		b.mu.RLock()
+		quit := b.quit
+		b.mu.RUnlock()
+		<-quit
+		return 0, errors.New("Bus closed")
+	}
+	return data, nil
 }
 
-// Which returns the address of the first bus with waiting data
+// Peek returns the next value Recv would get from a bus without blocking
+// or consuming it. The value is held back from the channel until the next
+// Recv, so like Recv it should only be called by the cpu.
+func (b *Bus) Peek(addr uint8) (uint16, bool) {
+	if int(addr) >= len(b.ch) {
+		return 0, false
+	}
+	c := &b.ch[addr]
+	if !c.held {
+		select {
+		case c.head = <-c.in:
+			c.held = true
+		default:
+			return 0, false
+		}
+	}
+	return c.head, true
+}
+
+// Which returns the address of the first bus with waiting data. Any data
+// found is held for the next Recv, as with Peek.
 func (b *Bus) Which() (uint8, error) {
-	if len(b.wait) > 0 {
-		return b.wait[0], nil
+	for i := range b.ch {
+		if _, ok := b.Peek(uint8(i)); ok {
+			return uint8(i), nil
+		}
 	}
 	return 0, errors.New("No data")
 }
 
+// Subscribe opts a bus in to receiving broadcasts
+func (b *Bus) Subscribe(addr uint8) error {
+	if int(addr) >= len(b.ch) {
+		return errors.New("Invalid bus address")
+	}
+	b.ch[addr].broadcast = true
+	return nil
+}
+
+// Broadcast puts data on every subscribed bus without blocking.
+// Busses that aren't ready to take it are skipped and reported.
+func (b *Bus) Broadcast(data uint16) error {
+	var missed []int
+	for i := range b.ch {
+		if !b.ch[i].broadcast {
+			continue
+		}
+		select {
+		case b.ch[i].out <- data:
+		default:
+			missed = append(missed, i)
+		}
+	}
+	if len(missed) > 0 {
+		return fmt.Errorf("Broadcast not delivered to busses %v", missed)
+	}
+	return nil
+}
+
+// inputEnd tracks the end of the input for the status bus and run. ended
+// is set once every word from the reader is on the input bus. told counts
+// the times the guest has received that, as an EOF word or a 1 from the
+// status bus. Words still buffered don't count, only what RBUS has taken.
+// over is closed when it's twice, see run.
+type inputEnd struct {
+	ended atomic.Bool
+	told  atomic.Int32
+	over  chan struct{}
+}
+
+func newInputEnd() *inputEnd {
+	return &inputEnd{over: make(chan struct{})}
+}
+
+// tell records the guest receiving the end of the input. The second time
+// it has carried on regardless, so tell says to stop it there, before it
+// does anything more.
+func (e *inputEnd) tell() (stop bool) {
+	if e.told.Add(1) != 2 {
+		return false
+	}
+	close(e.over)
+	return true
+}
+
+// eofWord is a Bus recvd for the input bus in bytes mode, telling end
+// about each EOF the guest reads
+func (e *inputEnd) eofWord(data uint16) bool {
+	return data == emu.EOF && e.tell()
+}
+
+// statusWord is a Bus recvd for the status bus, telling end about each 1
+// the guest reads
+func (e *inputEnd) statusWord(data uint16) bool {
+	return data == 1 && e.tell()
+}
+
+// feed copies r onto the data side of a bus, one byte per word. Once r is
+// exhausted the bus hands out emu.EOF on every read so the guest can't hang
+// waiting for input that will never come. Stops when the bus is closed.
+func (b *Bus) feed(addr int, r io.Reader, end *inputEnd) {
+	b.mu.RLock()
+	quit := b.quit
+	b.mu.RUnlock()
+	buf := make([]byte, 1)
+	for {
+		data := uint16(emu.EOF)
+		if n, err := r.Read(buf); n == 1 {
+			data = uint16(buf[0])
+		} else if err == nil {
+			continue
+		} else {
+			end.ended.Store(true)
+		}
+		select {
+		case b.ch[addr].in <- data:
+		case <-quit:
+			return
+		}
+	}
+}
+
+// oddByte is what feedWords does with a final byte that has no partner
+type oddByte int
+
+const (
+	oddPad  oddByte = iota // Send it as the high byte of a word, low byte 0
+	oddDrop                // Throw it away
+)
+
+// feedWords is feed for devices that want whole words: bytes from r are
+// buffered in pairs and each pair goes out as one big endian word. A short
+// read never splits a word; feedWords waits for the second byte until r
+// ends, then deals with a leftover byte according to odd. Every word value
+// is data, so there's no EOF word: the bus just goes quiet, and the status
+// bus says when that's for good.
+func (b *Bus) feedWords(addr int, r io.Reader, odd oddByte, end *inputEnd) {
+	b.mu.RLock()
+	quit := b.quit
+	b.mu.RUnlock()
+	buf := make([]byte, 2)
+	for {
+		var data uint16
+		n, err := io.ReadFull(r, buf)
+		switch {
+		case n == 2:
+			data = uint16(buf[0])<<8 | uint16(buf[1])
+		case n == 1 && odd == oddPad:
+			data = uint16(buf[0]) << 8
+		case err != nil:
+			end.ended.Store(true)
+			return
+		}
+		select {
+		case b.ch[addr].in <- data:
+		case <-quit:
+			return
+		}
+		if err != nil {
+			end.ended.Store(true)
+			return
+		}
+	}
+}
+
+// status serves the input's state on a bus, read with RBUS: 0 while more
+// input may come, 1 once all of it is on the input bus. Anything still
+// waiting there then is the last of it, so a guest polling the input with
+// PEEK checks it once more after reading 1.
+func (b *Bus) status(addr int, end *inputEnd) {
+	b.mu.RLock()
+	quit := b.quit
+	b.mu.RUnlock()
+	for {
+		var v uint16
+		if end.ended.Load() {
+			v = 1
+		}
+		select {
+		case b.ch[addr].in <- v:
+		case <-quit:
+			return
+		}
+	}
+}
+
+// watchdog resets the cpu if the guest stops kicking it. It sits idle until
+// the first word arrives on its bus. After that every word is a kick, and a
+// non-zero word also sets the timeout to that many milliseconds. If a
+// timeout passes without a kick, a reset interrupt is raised and the
+// watchdog goes idle again until the guest re-arms it.
+func (b *Bus) watchdog(addr int) {
+	b.mu.RLock()
+	quit := b.quit
+	b.mu.RUnlock()
+	timeout := time.Second
+	timer := time.NewTimer(timeout)
+	timer.Stop()
+	for {
+		select {
+		case kick := <-b.ch[addr].out:
+			if kick != 0 {
+				timeout = time.Duration(kick) * time.Millisecond
+			}
+			timer.Reset(timeout)
+		case <-timer.C:
+			b.Raise(emu.Interrupt{BusAddr: uint8(addr), Reset: true})
+		case <-quit:
+			timer.Stop()
+			return
+		}
+	}
+}
+
 // Interrupts receives an interrupt chan from cpu
 func (b *Bus) Interrupts(c chan<- emu.Interrupt) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
 	b.c = c
+	if b.quit == nil {
+		b.quit = make(chan struct{})
+	}
 	return
 }
 
-//==================================================\\
-// BOOTMEDIA Modules
-//==================================================\\
-
-// Bootmedia initializes memory and cpu
-type Bootmedia struct {
-	offset uint16
-	length uint16
-	start  uint16
-	data   []uint8
+// Raise delivers an interrupt from a device to the cpu. It is safe to race
+// with Close; once closing has begun the interrupt is dropped with an error.
+func (b *Bus) Raise(i emu.Interrupt) error {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	if b.c == nil || b.closed {
+		return errors.New("Interrupts are closed")
+	}
+	select {
+	case b.c <- i:
+		return nil
+	case <-b.quit:
+		return errors.New("Interrupts are closed")
+	}
 }
 
-func (b *Bootmedia) init(data []uint8, offset, start uint16) error {
-	b.data = data
-	b.length = uint16(len(data))
-	b.offset = offset
-	b.start = start
-	return nil
+// Close shuts the interrupt chan, which stops the cpu
+func (b *Bus) Close() {
+	b.mu.RLock()
+	quit := b.quit
+	b.mu.RUnlock()
+	if quit != nil {
+		b.quitOnce.Do(func() { close(quit) })
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.c != nil && !b.closed {
+		close(b.c)
+		b.closed = true
+	}
 }
 
-// GetOffset tells us where to start writing mem
-func (b *Bootmedia) GetOffset() (uint16, error) {
-	return b.offset, nil
-}
+//==================================================\\
+// DEVICES
+//==================================================\\
 
-// GetLength states how much data is to be loaded from bootmedia
-func (b *Bootmedia) GetLength() (uint16, error) {
-	return b.length, nil
+// terminal renders the tty bus. Each word is two bytes, high first, and a
+// zero byte is padding, so a word can carry one character or two. Printable
+// bytes are written as is; the control bytes emu defines as TTYBackspace
+// and so on are interpreted and any others are dropped, so a guest can't
+// send raw escape sequences.
+type terminal struct {
+	w    io.Writer
+	move []byte // Arguments collected for emu.TTYMove, nil when not moving
 }
 
-// GetIP returns the initial instruction pointer
-func (b *Bootmedia) GetIP() (uint16, error) {
-	return b.start, nil
+func (t *terminal) put(word uint16) {
+	t.putByte(byte(word >> 8))
+	t.putByte(byte(word))
 }
 
-// Load gets the boot data at a certain byte
-func (b *Bootmedia) Load(addr uint16) (uint8, error) {
-	if addr > b.length {
-		return 0, errors.New("Load outside of bootmedia")
+func (t *terminal) putByte(b byte) {
+	if t.move != nil {
+		if t.move = append(t.move, b); len(t.move) == 2 {
+			fmt.Fprintf(t.w, "\033[%d;%dH", t.move[0], t.move[1])
+			t.move = nil
+		}
+		return
+	}
+	switch {
+	case b == 0:
+	case b == emu.TTYBackspace, b == emu.TTYTab, b == emu.TTYNewline, b == emu.TTYReturn:
+		t.w.Write([]byte{b})
+	case b == emu.TTYClear:
+		fmt.Fprint(t.w, "\033[2J\033[1;1H")
+	case b == emu.TTYMove:
+		t.move = []byte{}
+	case b < 0x20 || b == 0x7f:
+	default:
+		t.w.Write([]byte{b})
 	}
-	return b.data[addr], nil
 }
 
 //==================================================\\
 // LOAD FILES
 //==================================================\\
-func parseFile() (data []uint8, offset uint16, pointer uint16, err error) {
-	if len(os.Args) < 2 {
+func parseFile(order binary.ByteOrder) (img emu.Image, err error) {
+	if flag.NArg() < 1 {
 		err = errors.New("Program name required")
 		return
 	}
 
-	raw, err := ioutil.ReadFile(os.Args[1])
+	raw, err := ioutil.ReadFile(flag.Arg(0))
 	if err != nil {
 		return
 	}
-	holder := ""
-ParseLoop:
-	for i := 0; i < len(raw); i++ {
-		if raw[i] == 10 || raw[i] == 32 || raw[i] == 44 {
-			// Hit a delimiter, see if we have data to add
-			if holder != "" {
-				b, e := hex.DecodeString(holder)
-				if e != nil {
-					panic(e)
-				}
-				data = append(data, uint8(b[0]))
-				holder = ""
-			}
-			continue ParseLoop // Skip newlines, spaces, and commas
-		}
-		if raw[i] == 35 {
-			// Found a "#" which begins a comment.
-			// Increase i until we hit newline or end of input
-			for {
-				i++
-				if raw[i] == 10 || i == len(raw)-1 {
-					continue ParseLoop
-				}
-			}
-		}
-		holder += string(raw[i])
-	}
-	if len(data) < 5 {
-		err = errors.New("Not enough data to run a program")
-	}
-	offset = uint16(data[0])<<8 | uint16(data[1])
-	pointer = uint16(data[2])<<8 | uint16(data[3])
-	data = data[4:]
-
-	return
+	return emu.ParseImage(raw, order)
 }
 
 //===============================
 // MAIN BODY
 //===============================
 
+// config is how run sets up the machine, from main's flags. Bus sizes
+// are buffers: buffered output busses let the cpu keep going while the
+// host catches up; unbuffered ones keep the two in lock step.
+type config struct {
+	raw, tty, done, input int           // Buffer size of each bus
+	inputMode             string        // bytes, words or words-drop
+	scrub                 uint64        // Flip a random memory bit every scrub instructions, 0 never
+	seed                  int64         // Seed for the scrubber
+	uninit                bool          // Fail loads of memory nothing has written
+	regions               uint16        // Count accesses in buckets this many bytes wide, 0 not at all
+	accessLog             io.Writer     // Where every memory access is logged, nil for nowhere
+	tick                  time.Duration // Time between instructions
+}
+
 func main() {
-	fmt.Print("\033[2J")
-	fmt.Print("\033[1;1H")
-	fmt.Printf("Initializing resources...")
+	var cfg config
+	flag.IntVar(&cfg.raw, "rawbuf", 0, "buffer size of the raw output bus")
+	flag.IntVar(&cfg.tty, "ttybuf", 0, "buffer size of the tty bus")
+	flag.IntVar(&cfg.done, "donebuf", 0, "buffer size of the done bus")
+	flag.IntVar(&cfg.input, "inputbuf", 0, "buffer size of the input bus")
+	flag.StringVar(&cfg.inputMode, "inputmode", "bytes", "bytes sends one input byte per word; words packs two, padding a final odd byte, and words-drop drops it")
+	flag.Uint64Var(&cfg.scrub, "scrub", 0, "flip a random bit of memory every this many instructions, 0 to never")
+	flag.Int64Var(&cfg.seed, "seed", 1, "seed for -scrub, the same seed gives the same faults")
+	flag.BoolVar(&cfg.uninit, "uninit", false, "fail reads of memory nothing has written, the loaded program excepted")
+	regions := flag.Uint("regions", 0, "count memory accesses in regions this many bytes wide and list them at the end, 0 to not count")
+	accessLog := flag.String("accesslog", "", "log every memory load and store to this file")
+	flag.DurationVar(&cfg.tick, "tick", 200*time.Millisecond, "time between instructions")
+	header := flag.String("header", "big", "byte order of the program header, big or little")
+	flag.Parse()
+	if *regions > 0xFFFF {
+		panic(fmt.Sprintf("Region size %d is more than the address space", *regions))
+	}
+	cfg.regions = uint16(*regions)
+
+	var order binary.ByteOrder
+	switch *header {
+	case "big":
+		order = binary.BigEndian
+	case "little":
+		order = binary.LittleEndian
+	default:
+		panic(fmt.Sprintf("Unknown header byte order %q", *header))
+	}
+	switch cfg.inputMode {
+	case "bytes", "words", "words-drop":
+	default:
+		panic(fmt.Sprintf("Unknown input mode %q", cfg.inputMode))
+	}
+	img, err := parseFile(order)
+	if err != nil {
+		panic(err)
+	}
+	if *accessLog != "" {
+		f, err := os.Create(*accessLog)
+		if err != nil {
+			panic(err)
+		}
+		defer f.Close()
+		log := bufio.NewWriter(f)
+		defer log.Flush()
+		cfg.accessLog = log
+	}
+	run(os.Stdout, os.Stdin, cfg, img)
+}
 
-	tick := time.NewTicker(time.Millisecond * 200).C
+// run boots the program and services its busses until it finishes.
+// Everything shown to the user, screen control included, goes to w,
+// and the input bus reads from r.
+func run(w io.Writer, r io.Reader, cfg config, img emu.Image) {
+	fmt.Fprint(w, "\033[2J")
+	fmt.Fprint(w, "\033[1;1H")
+	fmt.Fprintf(w, "Initializing resources...")
 
-	m := Mem{}
-	m.newBanks(16384) // Init with 16K of ram
+	tick := time.NewTicker(cfg.tick).C
 
-	bm := Bootmedia{}
+	m := Mem{CheckUninit: cfg.uninit, RegionSize: cfg.regions}
+	if cfg.accessLog != nil {
+		m.Log = emu.LogAccesses(cfg.accessLog)
+	}
+	m.newBanks(1, 16384) // Init with 16K of ram
 
 	// For the following program, registers are used as follows
 	// 15 - Instruction pointer (reserved)
@@ -252,52 +715,104 @@ func main() {
 		0x25, 0x01, 0x0b, // Prep bus driver to kill process
 		0x45, // And quit
 	}*/
-	data, offset, pointer, err := parseFile()
-	if err != nil {
-		panic(err)
-	}
 	// Data from above, load into beginning of memory (0), and start instruction pointer at 0x02
-	err = bm.init(data, offset, pointer)
-	if err != nil {
-		panic(err)
-	}
+	bm := img.Bootmedia()
 
 	bu := Bus{}
-	raw := bu.newBus(0)
-	tty := bu.newBus(0)
-	done := bu.newBus(0)
-
-	fmt.Printf("done\nCreating new processor...")
-	proc := emu.NewProcessor(&m, &bm, &bu, tick)
-	fmt.Printf("done\nBooting...")
+	raw := bu.newBus(cfg.raw)
+	tty := bu.newBus(cfg.tty)
+	done := bu.newBus(cfg.done)
+	input := bu.newBus(cfg.input)
+	watchdog := bu.newBus(0)
+	status := bu.newBus(0)
+	// Broadcasts are shown on both output devices. done and watchdog stay
+	// out of it, one word there ends the program or arms a reset.
+	bu.Subscribe(uint8(raw))
+	bu.Subscribe(uint8(tty))
+
+	fmt.Fprintf(w, "done\nCreating new processor...")
+	proc := emu.NewProcessor(&m, bm, &bu, tick)
+	if cfg.scrub > 0 {
+		scrub := emu.NewScrubber(m.Quiet(), cfg.seed, 0, uint32(m.BankSize()), cfg.scrub)
+		proc.AfterExec = scrub.Hook()
+	}
+	end := newInputEnd()
+	switch cfg.inputMode {
+	case "words":
+		go bu.feedWords(input, r, oddPad, end)
+	case "words-drop":
+		go bu.feedWords(input, r, oddDrop, end)
+	default:
+		bu.ch[input].recvd = end.eofWord
+		go bu.feed(input, r, end)
+	}
+	bu.ch[status].recvd = end.statusWord
+	go bu.status(status, end)
+	go bu.watchdog(watchdog)
+	fmt.Fprintf(w, "done\nBooting...")
 	proc.Boot()
-	fmt.Printf("done\nRunning processor\n\n")
+	fmt.Fprintf(w, "done\nRunning processor\n\n")
 
 	errorChan := make(chan error)
-	go proc.Run(errorChan)
+	stopped := make(chan struct{}) // Run returned, after HALT say
+	go func() {
+		proc.Run(errorChan)
+		close(stopped)
+	}()
+
+	printRaw := func(output uint16) {
+		fmt.Fprintf(w, "%d ", output)
+	}
+	term := &terminal{w: w}
 
 	tick2 := time.NewTicker(time.Millisecond * 100).C
+	failed := false
 Mainloop:
 	for {
 		select {
 		case e := <-errorChan:
-			fmt.Printf("\n-- Error: %s --\n", e)
+			fmt.Fprintf(w, "\n-- Error: %s --\n", e)
+			failed = true
 			break Mainloop
 		case output := <-bu.ch[raw].out:
-			fmt.Printf("%d ", output)
+			printRaw(output)
 		case output := <-bu.ch[tty].out:
-			h := byte(output >> 8)
-			l := byte(output & 0xff)
-			if h == 0 {
-				fmt.Printf("%c", l)
-			} else {
-				fmt.Printf("%c%c", h, l)
-			}
+			term.put(output)
 		case <-bu.ch[done].out:
-			fmt.Println("\nDone")
-			close(bu.c)
+			break Mainloop
+		case <-stopped:
+			break Mainloop
+		case <-end.over:
+			// The guest read the end of the input a second time, so it
+			// isn't going to stop by itself. It's held in that RBUS, and
+			// anything it sent before is here or in the buffers.
+			fmt.Fprint(w, "\n-- End of input --")
 			break Mainloop
 		case <-tick2:
 		}
 	}
+	// Buffered output sent before the end may still be waiting
+	for len(bu.ch[raw].out) > 0 || len(bu.ch[tty].out) > 0 {
+		select {
+		case output := <-bu.ch[raw].out:
+			printRaw(output)
+		case output := <-bu.ch[tty].out:
+			term.put(output)
+		}
+	}
+	if !failed {
+		fmt.Fprintln(w, "\nDone")
+	}
+	bu.Close()
+	if cfg.regions > 0 {
+		printRegions(w, m.Regions())
+	}
+}
+
+// printRegions lists access counts by region, lowest address first
+func printRegions(w io.Writer, regions map[uint16]uint64) {
+	fmt.Fprintln(w, "\nAccesses by region:")
+	for _, addr := range slices.Sorted(maps.Keys(regions)) {
+		fmt.Fprintf(w, "%04x %d\n", addr, regions[addr])
+	}
 }
@@ -0,0 +1,384 @@
+package main
+
+import (
+	"bytes"
+	"maps"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/jensenak/emu16/emu"
+)
+
+// newTestBus makes a Bus with its quit chan, as NewProcessor would
+func newTestBus() *Bus {
+	bu := &Bus{}
+	bu.Interrupts(make(chan emu.Interrupt))
+	return bu
+}
+
+func TestFeedWords(t *testing.T) {
+	for _, tc := range []struct {
+		in   []byte
+		odd  oddByte
+		want []uint16
+	}{
+		{[]byte{1, 2, 0xff, 0xff}, oddPad, []uint16{0x0102, 0xffff}},
+		{[]byte{1, 2, 3}, oddPad, []uint16{0x0102, 0x0300}},
+		{[]byte{1, 2, 3}, oddDrop, []uint16{0x0102}},
+		{nil, oddPad, nil},
+	} {
+		bu := newTestBus()
+		in, st := bu.newBus(8), bu.newBus(0)
+		end := newInputEnd()
+		go bu.status(st, end)
+		if v := <-bu.ch[st].in; v != 0 {
+			t.Fatalf("%v: status %d before feeding", tc.in, v)
+		}
+		bu.feedWords(in, bytes.NewReader(tc.in), tc.odd, end)
+		var got []uint16
+		for len(bu.ch[in].in) > 0 {
+			got = append(got, <-bu.ch[in].in)
+		}
+		if !slices.Equal(got, tc.want) {
+			t.Errorf("%v: got %x, want %x", tc.in, got, tc.want)
+		}
+		<-bu.ch[st].in // May have been worked out before the end
+		if v := <-bu.ch[st].in; v != 1 {
+			t.Errorf("%v: status %d after the end", tc.in, v)
+		}
+		bu.Close()
+	}
+}
+
+// echo copies the input bus to the raw bus, stopping at EOF if halt is set
+func echo(t *testing.T, halt bool) emu.Image {
+	src := `
+		set r0, 0x0301 ; Input bus into r1
+		set r2, 0x0001 ; Raw bus from r1
+		set r3, loop
+		set r4, 0xffff
+		set r5, end
+	loop:
+		rbus r0
+`
+	if halt {
+		src += "\t\tejump r1, r4, r5\n"
+	}
+	src += `
+		sbus r2
+		ejump r0, r0, r3
+	end:
+		halt
+`
+	img, err := emu.AssembleImage(src, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return img
+}
+
+func TestRunEndOfInput(t *testing.T) {
+	for _, tc := range []struct {
+		halt  bool
+		input int // Input bus buffer
+		want  string
+	}{
+		{true, 0, "97 98 \nDone\n"},
+		{true, 4, "97 98 \nDone\n"},
+		// Echoes the first EOF, then is stopped reading the second
+		{false, 0, "97 98 65535 \n-- End of input --\nDone\n"},
+		{false, 4, "97 98 65535 \n-- End of input --\nDone\n"},
+	} {
+		var out bytes.Buffer
+		finished := make(chan struct{})
+		go func() {
+			cfg := config{inputMode: "bytes", input: tc.input, tick: time.Microsecond}
+			run(&out, strings.NewReader("ab"), cfg, echo(t, tc.halt))
+			close(finished)
+		}()
+		select {
+		case <-finished:
+		case <-time.After(5 * time.Second):
+			t.Fatalf("halt %v input %d: run didn't return", tc.halt, tc.input)
+		}
+		_, got, _ := strings.Cut(out.String(), "Running processor\n\n")
+		if got != tc.want {
+			t.Errorf("halt %v input %d: got %q, want %q", tc.halt, tc.input, got, tc.want)
+		}
+	}
+}
+
+func TestCloseWhileRaising(t *testing.T) {
+	bu := &Bus{}
+	bu.Interrupts(make(chan emu.Interrupt)) // Nobody takes from it
+	raised := make(chan error)
+	go func() { raised <- bu.Raise(emu.Interrupt{BusAddr: 1}) }()
+	time.Sleep(10 * time.Millisecond) // Let Raise block
+	bu.Close()
+	select {
+	case err := <-raised:
+		if err == nil {
+			t.Error("Raise reported delivery after Close")
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Raise still blocked after Close")
+	}
+	if err := bu.Raise(emu.Interrupt{BusAddr: 1}); err == nil {
+		t.Error("Raise after Close reported delivery")
+	}
+}
+
+func TestRunOutput(t *testing.T) {
+	img, err := emu.AssembleImage(`
+		set r0, 0x0001 ; Raw bus from r1
+		set r1, 42
+		sbus r0
+		set r0, 0x0101 ; tty
+		set r1, 0x6869 ; "hi"
+		sbus r0
+		set r0, 0x0201 ; done
+		sbus r0
+	`, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var out bytes.Buffer
+	run(&out, strings.NewReader(""), config{inputMode: "bytes", tick: time.Microsecond}, img)
+	want := "\033[2J\033[1;1HInitializing resources...done\nCreating new processor...done\nBooting...done\nRunning processor\n\n42 hi\nDone\n"
+	if got := out.String(); got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
+
+func TestBufferedSend(t *testing.T) {
+	bu := newTestBus()
+	out := bu.newBus(3)
+	sent := make(chan struct{})
+	go func() {
+		for i := range uint16(4) {
+			bu.Send(uint8(out), i)
+			sent <- struct{}{}
+		}
+	}()
+	for i := range 3 {
+		select {
+		case <-sent:
+		case <-time.After(time.Second):
+			t.Fatalf("send %d blocked with room in the buffer", i)
+		}
+	}
+	select {
+	case <-sent:
+		t.Fatal("send didn't block on a full buffer")
+	case <-time.After(20 * time.Millisecond):
+	}
+	if v := <-bu.ch[out].out; v != 0 {
+		t.Errorf("first out %d, want 0", v)
+	}
+	<-sent // The fourth goes in once there's room
+}
+
+func TestWatchdog(t *testing.T) {
+	ints := make(chan emu.Interrupt, 1)
+	bu := &Bus{}
+	bu.Interrupts(ints)
+	defer bu.Close()
+	wd := bu.newBus(0)
+	go bu.watchdog(wd)
+
+	bu.ch[wd].out <- 200 // Arm with a 200ms timeout
+	for range 10 {
+		time.Sleep(30 * time.Millisecond)
+		bu.ch[wd].out <- 0 // Kick
+	}
+	select {
+	case i := <-ints:
+		t.Fatalf("got %+v while being kicked", i)
+	default:
+	}
+
+	select {
+	case i := <-ints:
+		if !i.Reset || i.BusAddr != uint8(wd) {
+			t.Errorf("got %+v, want a reset from bus %d", i, wd)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("no reset once the kicks stopped")
+	}
+}
+
+func TestTerminal(t *testing.T) {
+	for _, tc := range []struct {
+		name  string
+		words []uint16
+		want  string
+	}{
+		{"two a word", []uint16{0x6869, 0x0021}, "hi!"},
+		{"padding", []uint16{0x0068, 0x6900}, "hi"},
+		{"line control", []uint16{0x6108, 0x090a, 0x0d00}, "a\b\t\n\r"},
+		{"clear", []uint16{0x610c}, "a\033[2J\033[1;1H"},
+		{"move", []uint16{0x1003, 0x0478}, "\033[3;4Hx"},
+		{"move split over words", []uint16{0x0010, 0x0305}, "\033[3;5H"},
+		{"other control dropped", []uint16{0x1b5b, 0x7f41}, "[A"},
+	} {
+		var out bytes.Buffer
+		term := &terminal{w: &out}
+		for _, w := range tc.words {
+			term.put(w)
+		}
+		if got := out.String(); got != tc.want {
+			t.Errorf("%s: got %q, want %q", tc.name, got, tc.want)
+		}
+	}
+}
+
+func TestUninitRead(t *testing.T) {
+	code, err := emu.Assemble(`
+		set r1, 0x80
+		load r2, r1    ; Never written
+		store r2, r1
+		load r3, r1    ; Now it has been
+		set r4, data
+		load r5, r4    ; Part of the program
+		set r6, 0x7f
+		load r7, r6    ; 7f unwritten, 80 written
+	data:
+		.word 0xbeef
+	`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	m := &Mem{CheckUninit: true}
+	m.newBanks(2, 0x100)
+	p := emu.NewProcessor(m, emu.NewBootmedia(code, 0, 0), newTestBus(), nil)
+	if err := p.Boot(); err != nil {
+		t.Fatal(err)
+	}
+	step := func() error {
+		_, err := p.Step()
+		return err
+	}
+	if err := step(); err != nil {
+		t.Fatal(err)
+	}
+	if err := step(); err == nil || !strings.Contains(err.Error(), "Uninitialized read of 80") {
+		t.Errorf("reading 80 gave %v", err)
+	}
+	for range 4 {
+		if err := step(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if r5 := p.Register[5].Get16(); r5 != 0xbeef {
+		t.Errorf("read %#x from the program's data", r5)
+	}
+	if err := step(); err != nil {
+		t.Fatal(err)
+	}
+	if err := step(); err == nil || !strings.Contains(err.Error(), "Uninitialized read of 7f") {
+		t.Errorf("reading the word at 7f gave %v", err)
+	}
+
+	// Each bank keeps its own record
+	m.SelectBank(1)
+	if _, err := m.Load8(0, 0); err == nil {
+		t.Error("bank 1 counts bank 0's program as written")
+	}
+	m.CheckUninit = false
+	if _, err := m.Load8(0x90, 0); err != nil {
+		t.Errorf("unchecked read: %v", err)
+	}
+}
+
+func TestScrubberQuiet(t *testing.T) {
+	var logged []emu.Access
+	m := &Mem{RegionSize: 0x10, Log: func(a emu.Access) { logged = append(logged, a) }}
+	m.newBanks(1, 0x100)
+	s := emu.NewScrubber(m.Quiet(), 1, 0, uint32(m.BankSize()), 1)
+	for range 20 {
+		if err := s.Step(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if len(s.Faults()) != 20 || !slices.ContainsFunc(m.banks[0], func(b uint8) bool { return b != 0 }) {
+		t.Fatalf("made faults %v, memory unchanged", s.Faults())
+	}
+	if len(logged) != 0 || len(m.Regions()) != 0 {
+		t.Errorf("the scrubber's accesses were logged %v and counted %v", logged, m.Regions())
+	}
+}
+
+func TestAccessLog(t *testing.T) {
+	code, err := emu.Assemble(`
+		set r1, 0x80
+		set r2, 0xbeef
+		store r2, r1
+		load r3, r1
+	`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	m := &Mem{}
+	m.newBanks(1, 0x100)
+	p := emu.NewProcessor(m, emu.NewBootmedia(code, 0, 0), newTestBus(), nil)
+	if err := p.Boot(); err != nil {
+		t.Fatal(err)
+	}
+	var logged strings.Builder
+	m.Log = emu.LogAccesses(&logged) // After Boot, which saves the image
+	for range 4 {
+		if _, err := p.Step(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	want := strings.Join([]string{
+		"R8 0000 21", // set r1: the word a byte at a time, then the immediate
+		"R8 0001 00",
+		"R16 0001 0080",
+		"R8 0003 22",
+		"R8 0004 be",
+		"R16 0004 beef",
+		"R8 0006 12", // store r2, r1
+		"R8 0007 10",
+		"W16 0080 beef",
+		"R8 0008 03", // load r3, r1
+		"R8 0009 10",
+		"R16 0080 beef",
+	}, "\n") + "\n"
+	if got := logged.String(); got != want {
+		t.Errorf("logged\n%s\nwant\n%s", got, want)
+	}
+}
+
+func TestRegions(t *testing.T) {
+	code, err := emu.Assemble(`
+		set r1, 0x80
+		set r2, 0xbeef
+		set r4, 0x4f
+		store r2, r1
+		store r2, r4 ; Counted at 40, where it starts
+		load r3, r1
+	`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	m := &Mem{RegionSize: 0x10}
+	m.newBanks(1, 0x100)
+	p := emu.NewProcessor(m, emu.NewBootmedia(code, 0, 0), newTestBus(), nil)
+	if err := p.Boot(); err != nil {
+		t.Fatal(err)
+	}
+	for range 6 {
+		if _, err := p.Step(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// Boot saves the 15 bytes of code one at a time. Running them takes
+	// two fetch reads each and an immediate read for each set.
+	want := map[uint16]uint64{0x00: 15 + 6*2 + 3, 0x40: 1, 0x80: 2}
+	if got := m.Regions(); !maps.Equal(got, want) {
+		t.Errorf("regions %v, want %v", got, want)
+	}
+}